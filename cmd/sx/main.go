@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof"
@@ -14,10 +20,11 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"github.com/trapped/sx"
 	"github.com/trapped/sx/pkg/debounce"
 	"github.com/trapped/sx/pkg/fasthttp"
+	"github.com/trapped/sx/pkg/health"
 	h "github.com/trapped/sx/pkg/http"
+	"github.com/trapped/sx/pkg/reload"
 )
 
 var (
@@ -25,29 +32,27 @@ var (
 	pprofListenAddr = flag.String("pprof", ":6060", "pprof listen address")
 	configPath      = flag.String("f", "config.yml", "Path to configuration file")
 	fastHttp        = flag.Bool("fast", false, "Enables valyala/fasthttp for extra performance")
+	watchMode       = flag.String("watch-mode", "fsnotify", "How to watch the configuration file for changes: fsnotify or poll")
+	watchInterval   = flag.Duration("watch-interval", 10*time.Second, "Configuration polling interval, with -watch-mode=poll")
+	reloadDebounce  = flag.Duration("reload-debounce", 5*time.Second, "Delay before reloading a changed configuration, restarted by further changes")
+	reloadToken     = flag.String("reload-token", os.Getenv("SX_RELOAD_TOKEN"), "Bearer token required by POST /reload (default $SX_RELOAD_TOKEN); without one, only loopback clients can reload")
+	shutdownDelay   = flag.Duration("shutdown-delay", 5*time.Second, "Time between failing health checks and draining connections on SIGTERM")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for in-flight requests to complete on SIGTERM")
 )
 
-func readConf(path string) (*sx.GatewayConfig, error) {
-	conf := new(sx.GatewayConfig)
-	f, err := os.Open(*configPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "error opening configuration")
-	}
-	defer f.Close()
-	if err := conf.Read(f); err != nil {
-		return nil, errors.Wrap(err, "error reading configuration")
-	}
-	return conf, nil
-}
+// probe reports readiness, failing once SIGTERM was received.
+var probe = new(health.Probe)
 
-func watchConfig(path string, handler func(*sx.GatewayConfig) error) {
+// watchConfig calls onChange (debounced by delay) whenever the
+// configuration at path changes.
+func watchConfig(path string, delay time.Duration, onChange func()) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatalf("error creating configuration watcher: %v", err)
 	}
 	defer watcher.Close()
 
-	debounce := debounce.New(5 * time.Second)
+	debounce := debounce.New(delay)
 
 	/*
 		the following symlink-following logic was inspired by:
@@ -73,13 +78,7 @@ func watchConfig(path string, handler func(*sx.GatewayConfig) error) {
 					realPath = currentPath
 					debounce.Func(func() {
 						log.Println("reloading configuration")
-						conf, err := readConf(realPath)
-						if err != nil {
-							log.Printf("error reloading configuration, ignoring: %v", err)
-						}
-						if err := handler(conf); err != nil {
-							log.Printf("error reapplying configuration, ignoring: %v", err)
-						}
+						onChange()
 					})
 				}
 			case err := <-watcher.Errors:
@@ -100,45 +99,161 @@ func watchConfig(path string, handler func(*sx.GatewayConfig) error) {
 	<-done
 }
 
+// pollConfig calls onChange (debounced by delay) whenever the content of
+// the configuration at path changes, checking every interval. Symlinks
+// are followed each time, so it's meant for filesystems that don't deliver
+// fsnotify events (NFS, some FUSE mounts...).
+func pollConfig(path string, interval, delay time.Duration, onChange func()) {
+	debounce := debounce.New(delay)
+
+	path, _ = filepath.Abs(path)
+	last, err := hashConfig(path)
+	if err != nil {
+		log.Printf("error polling configuration: %v", err)
+	}
+
+	log.Printf("polling configuration %v every %s", path, interval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		sum, err := hashConfig(path)
+		if err != nil {
+			// the file may be in the middle of being replaced
+			log.Printf("error polling configuration: %v", err)
+			continue
+		}
+		if sum != last {
+			last = sum
+			debounce.Func(func() {
+				log.Println("reloading configuration")
+				onChange()
+			})
+		}
+	}
+}
+
+// hashConfig resolves path and returns the SHA-256 of its content.
+func hashConfig(path string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(realPath); err != nil {
+		return "", err
+	} else if !fi.Mode().IsRegular() {
+		return "", errors.Errorf("%s is not a regular file", realPath)
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// gateway is implemented by both the net/http and fasthttp gateways.
+type gateway interface {
+	reload.Loader
+	ListenAndServe(addr string) error
+	Shutdown(ctx context.Context) error
+	Checks(ctx context.Context) []health.Check
+}
+
+// shutdown fails readiness, waits for load balancers to notice, then
+// drains in-flight requests.
+func shutdown(g gateway) {
+	log.Printf("shutting down, draining connections in %s", *shutdownDelay)
+	probe.Shutdown()
+	time.Sleep(*shutdownDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		log.Printf("error draining connections: %v", err)
+		return
+	}
+	log.Println("all connections drained")
+}
+
 func main() {
 	flag.Parse()
+	if *watchMode == "poll" && *watchInterval <= 0 {
+		log.Fatalf("-watch-interval must be positive with -watch-mode=poll, got %s", *watchInterval)
+	}
 
-	conf, err := readConf(*configPath)
-	if err != nil {
-		log.Fatal(err)
+	var g gateway
+	if *fastHttp {
+		g = new(fasthttp.Gateway)
+	} else {
+		g = new(h.Gateway)
 	}
+	reloader := reload.New(*configPath, g)
+	reloader.Token = *reloadToken
+	probe.Add(func(ctx context.Context) []health.Check {
+		var err error
+		if reloader.LastGood() == nil {
+			err = errors.New("configuration not loaded")
+		}
+		return []health.Check{health.NewCheck("config", err)}
+	})
+	probe.Add(g.Checks)
 
 	log.Printf("pprof and metrics listening at %s", *pprofListenAddr)
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/reload", reloader)
+		http.HandleFunc("/livez", health.Live)
+		http.Handle("/readyz", probe)
+		// deprecated: use /livez and /readyz
 		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			if probe.ShuttingDown() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
 			w.Write([]byte("OK\n"))
 		})
 		log.Fatal(http.ListenAndServe(*pprofListenAddr, nil))
 	}()
 
-	log.Printf("listening at %s", *listenAddr)
-	if *fastHttp {
-		g := new(fasthttp.Gateway)
-		if err := g.LoadConfig(conf); err != nil {
-			log.Fatalf("error loading configuration: %v", err)
-		}
-		go watchConfig(*configPath, func(c *sx.GatewayConfig) error {
-			return g.LoadConfig(c)
-		})
-		if err := g.ListenAndServe(*listenAddr); err != nil {
-			log.Fatalf("error starting listener: %v", err)
-		}
-	} else {
-		g := new(h.Gateway)
-		if err := g.LoadConfig(conf); err != nil {
-			log.Fatalf("error loading configuration: %v", err)
+	if err := reloader.Reload(reload.TriggerStartup); err != nil {
+		log.Fatal(err)
+	}
+
+	onChange := func() {
+		reloader.Reload(reload.TriggerWatch)
+	}
+	switch *watchMode {
+	case "fsnotify":
+		go watchConfig(*configPath, *reloadDebounce, onChange)
+	case "poll":
+		go pollConfig(*configPath, *watchInterval, *reloadDebounce, onChange)
+	default:
+		log.Fatalf("unknown watch mode %q", *watchMode)
+	}
+
+	// SIGHUP reloads the configuration too
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			log.Println("reloading configuration (SIGHUP)")
+			reloader.Reload(reload.TriggerSignal)
 		}
-		go watchConfig(*configPath, func(c *sx.GatewayConfig) error {
-			return g.LoadConfig(c)
-		})
-		if err := g.ListenAndServe(*listenAddr); err != nil {
+	}()
+
+	log.Printf("listening at %s", *listenAddr)
+	go func() {
+		if err := g.ListenAndServe(*listenAddr); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("error starting listener: %v", err)
 		}
-	}
+	}()
+
+	// SIGTERM (or interrupt) shuts down gracefully
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	<-term
+	shutdown(g)
 }
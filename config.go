@@ -3,6 +3,9 @@ package sx
 import (
 	"fmt"
 	"io"
+	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,22 +16,59 @@ import (
 
 type GatewayConfig struct {
 	Redis    Redis      `yaml:"redis"`
+	Memory   Memory     `yaml:"memory"`
 	Services []*Service `yaml:"services"`
+
+	RetryBudget RetryBudget `yaml:"retrybudget"`
+	Deadline    Deadline    `yaml:"deadline"`
+	Errors      Errors      `yaml:"errors"`
 }
 
 // Read reads GatewayConfig from an io.Reader strictly, returning any
 // errors caused by invalid/missing values, required fields or extra
-// fields.
+// fields. It's equivalent to Decode followed by Validate.
 func (conf *GatewayConfig) Read(r io.Reader) error {
+	if err := conf.Decode(r); err != nil {
+		return err
+	}
+	return conf.Validate()
+}
+
+// Decode parses GatewayConfig from an io.Reader strictly, returning any
+// errors caused by malformed YAML or extra fields.
+func (conf *GatewayConfig) Decode(r io.Reader) error {
 	d := yaml.NewDecoder(r)
 	d.SetStrict(true)
 	if err := d.Decode(conf); err != nil {
 		return errors.Wrap(err, "error decoding yaml")
 	}
+	return nil
+}
+
+// Validate cleans up and validates a decoded GatewayConfig, returning any
+// errors caused by invalid/missing values or required fields. It also
+// links route groups to their parents, inheriting their settings.
+func (conf *GatewayConfig) Validate() error {
 	conf.Redis.clean()
 	if err := conf.Redis.validate(); err != nil {
 		return errors.Wrap(err, "error validating redis")
 	}
+	conf.Memory.clean()
+	if err := conf.Memory.validate(); err != nil {
+		return errors.Wrap(err, "error validating memory")
+	}
+	conf.RetryBudget.clean()
+	if err := conf.RetryBudget.validate(); err != nil {
+		return errors.Wrap(err, "error validating retrybudget")
+	}
+	conf.Deadline.clean()
+	if err := conf.Deadline.validate(); err != nil {
+		return errors.Wrap(err, "error validating deadline")
+	}
+	conf.Errors.clean()
+	if err := conf.Errors.validate(); err != nil {
+		return errors.Wrap(err, "error validating errors")
+	}
 	svcMap := make(map[string]bool)
 	for i, svc := range conf.Services {
 		svc.clean()
@@ -56,6 +96,18 @@ func (conf *GatewayConfig) Read(r io.Reader) error {
 				if g.RateLimit == nil && parent != nil {
 					g.RateLimit = parent.RateLimit
 				}
+				if g.Retry == nil && parent != nil {
+					g.Retry = parent.Retry
+				}
+				if g.Timeout == nil && parent != nil {
+					g.Timeout = parent.Timeout
+				}
+				if g.Hedge == nil && parent != nil {
+					g.Hedge = parent.Hedge
+				}
+				if g.MaxBodyBytes == 0 && parent != nil {
+					g.MaxBodyBytes = parent.MaxBodyBytes
+				}
 				return nil
 			}); err != nil {
 				return errors.Wrapf(err, "in service %q", svc.Name)
@@ -65,15 +117,65 @@ func (conf *GatewayConfig) Read(r io.Reader) error {
 	return nil
 }
 
+// Warnings returns the problems of a validated GatewayConfig that don't
+// prevent loading it, such as routes keeping state local to each replica.
+func (conf *GatewayConfig) Warnings() []string {
+	if conf.Redis.Configured() {
+		return nil
+	}
+	var warnings []string
+	for _, svc := range conf.Services {
+		for _, r := range svc.Routes {
+			r.Walk(func(parent, g *RouteGroup) error {
+				// inherited settings were already reported on the parent
+				local := g.Cache != nil || g.RateLimit != nil
+				if local && (parent == nil || g.Cache != parent.Cache || g.RateLimit != parent.RateLimit) {
+					warnings = append(warnings, fmt.Sprintf("route %q uses cache or ratelimit without redis, state will be local to each replica", g.Name))
+				}
+				return nil
+			})
+		}
+	}
+	return warnings
+}
+
 type Service struct {
 	Name       string `yaml:"name"`
 	PathPrefix string `yaml:"-"`
 
-	Addresses []string `yaml:"addresses"`
+	Addresses    []Address `yaml:"addresses"`
+	LoadBalancer string    `yaml:"loadbalancer"`
+	Hash         *Hash     `yaml:"hash"`
+	Sticky       *Sticky   `yaml:"sticky"`
+	// SlowStart ramps up linearly the traffic share of addresses added
+	// by a reload or recovering from failures over its duration.
+	SlowStart time.Duration `yaml:"slowstart"`
+
+	// Critical services fail readiness when none of their backends is
+	// reachable.
+	Critical bool `yaml:"critical"`
+
+	HealthCheck      *HealthCheck      `yaml:"healthcheck"`
+	OutlierDetection *OutlierDetection `yaml:"outlierdetection"`
+	CircuitBreaker   *CircuitBreaker   `yaml:"circuitbreaker"`
 
 	Routes []*RouteGroup `yaml:"routes"`
 }
 
+// SameBackends reports whether o defines the same backends as s, so
+// that their runtime state (connections, balancing...) can be kept
+// across reloads.
+func (s *Service) SameBackends(o *Service) bool {
+	return reflect.DeepEqual(s.Addresses, o.Addresses) &&
+		s.LoadBalancer == o.LoadBalancer &&
+		reflect.DeepEqual(s.Hash, o.Hash) &&
+		reflect.DeepEqual(s.Sticky, o.Sticky) &&
+		s.SlowStart == o.SlowStart &&
+		reflect.DeepEqual(s.HealthCheck, o.HealthCheck) &&
+		reflect.DeepEqual(s.OutlierDetection, o.OutlierDetection) &&
+		reflect.DeepEqual(s.CircuitBreaker, o.CircuitBreaker)
+}
+
 func (s *Service) CompileRoutes() (newroutes []Route, err error) {
 	for j := 0; j < len(s.Routes); j++ {
 		rg := s.Routes[j]
@@ -99,10 +201,29 @@ func (s *Service) CompileRoutes() (newroutes []Route, err error) {
 
 func (s *Service) clean() {
 	s.Name = strings.TrimSpace(s.Name)
-	for i, addr := range s.Addresses {
-		s.Addresses[i] = strings.TrimSpace(addr)
+	for i := range s.Addresses {
+		s.Addresses[i].clean()
+	}
+	s.LoadBalancer = strings.ToLower(strings.TrimSpace(s.LoadBalancer))
+	if s.LoadBalancer == "" {
+		s.LoadBalancer = LoadBalancerRoundRobin
+	}
+	if s.Hash != nil {
+		s.Hash.clean()
+	}
+	if s.Sticky != nil {
+		s.Sticky.clean()
 	}
 	s.PathPrefix = fmt.Sprintf("/%s", s.Name)
+	if s.HealthCheck != nil {
+		s.HealthCheck.clean()
+	}
+	if s.OutlierDetection != nil {
+		s.OutlierDetection.clean()
+	}
+	if s.CircuitBreaker != nil {
+		s.CircuitBreaker.clean()
+	}
 	for _, rg := range s.Routes {
 		rg.clean()
 	}
@@ -115,6 +236,50 @@ func (s *Service) validate(conf *GatewayConfig, svcIdx int) error {
 	if s.Addresses == nil || len(s.Addresses) < 1 {
 		return errors.Errorf("in service %q: addresses is required", s.Name)
 	}
+	for _, addr := range s.Addresses {
+		if err := addr.validate(); err != nil {
+			return errors.Wrapf(err, "in service %q", s.Name)
+		}
+	}
+	switch s.LoadBalancer {
+	case LoadBalancerRoundRobin, LoadBalancerWeightedRoundRobin, LoadBalancerLeastConnections,
+		LoadBalancerRandomTwoChoices, LoadBalancerEWMALatency:
+		if s.Hash != nil {
+			return errors.Errorf("in service %q: hash is only supported by the %s loadbalancer", s.Name, LoadBalancerHash)
+		}
+	case LoadBalancerHash:
+		if s.Hash == nil {
+			return errors.Errorf("in service %q: the %s loadbalancer needs hash", s.Name, LoadBalancerHash)
+		}
+		if err := s.Hash.validate(); err != nil {
+			return errors.Wrapf(err, "in service %q", s.Name)
+		}
+	default:
+		return errors.Errorf("in service %q: unknown loadbalancer %q", s.Name, s.LoadBalancer)
+	}
+	if s.SlowStart < 0 {
+		return errors.Errorf("in service %q: slowstart must be positive", s.Name)
+	}
+	if s.Sticky != nil {
+		if err := s.Sticky.validate(); err != nil {
+			return errors.Wrapf(err, "in service %q: can't validate sticky", s.Name)
+		}
+	}
+	if s.HealthCheck != nil {
+		if err := s.HealthCheck.validate(); err != nil {
+			return errors.Wrapf(err, "in service %q: can't validate healthcheck", s.Name)
+		}
+	}
+	if s.OutlierDetection != nil {
+		if err := s.OutlierDetection.validate(); err != nil {
+			return errors.Wrapf(err, "in service %q: can't validate outlierdetection", s.Name)
+		}
+	}
+	if s.CircuitBreaker != nil {
+		if err := s.CircuitBreaker.validate(); err != nil {
+			return errors.Wrapf(err, "in service %q: can't validate circuitbreaker", s.Name)
+		}
+	}
 	for _, rg := range s.Routes {
 		if err := rg.validate(conf); err != nil {
 			return errors.Wrapf(err, "in service %q", s.Name)
@@ -123,6 +288,463 @@ func (s *Service) validate(conf *GatewayConfig, svcIdx int) error {
 	return nil
 }
 
+// Load balancing strategies.
+const (
+	LoadBalancerRoundRobin         = "round_robin"
+	LoadBalancerWeightedRoundRobin = "weighted_round_robin"
+	LoadBalancerLeastConnections   = "least_connections"
+	LoadBalancerRandomTwoChoices   = "random_two_choices"
+	LoadBalancerEWMALatency        = "ewma_latency"
+	LoadBalancerHash               = "hash"
+)
+
+// Hash configures consistent hash load balancing: requests with the same
+// keys are sent to the same backend, and adding or removing an address
+// only remaps a fraction of keys. Requests where every key is empty are
+// balanced round-robin.
+type Hash struct {
+	Keys []CacheKey `yaml:"keys"`
+}
+
+func (h *Hash) clean() {
+	for i, k := range h.Keys {
+		k.clean()
+		h.Keys[i] = k
+	}
+}
+
+func (h *Hash) validate() error {
+	if len(h.Keys) == 0 {
+		return errors.Errorf("hash needs at least one key")
+	}
+	for _, k := range h.Keys {
+		if err := k.validate(); err != nil {
+			return errors.Wrap(err, "hash can't validate cache key")
+		}
+	}
+	return nil
+}
+
+// Address is a service backend address, with a load balancing weight (1
+// by default). It can be written either as a plain string or as a map:
+//
+//	addresses:
+//	  - localhost:8080
+//	  - address: localhost:8081
+//	    weight: 3
+type Address struct {
+	Address string `yaml:"address"`
+	Weight  int    `yaml:"weight"`
+}
+
+func (a *Address) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&a.Address); err == nil {
+		a.Weight = 1
+		return nil
+	}
+	// only an unset weight defaults to 1, an explicit 0 is invalid
+	var address struct {
+		Address string `yaml:"address"`
+		Weight  *int   `yaml:"weight"`
+	}
+	if err := unmarshal(&address); err != nil {
+		return err
+	}
+	a.Address, a.Weight = address.Address, 1
+	if address.Weight != nil {
+		a.Weight = *address.Weight
+	}
+	return nil
+}
+
+func (a *Address) clean() {
+	a.Address = strings.TrimSpace(a.Address)
+}
+
+func (a *Address) validate() error {
+	if a.Address == "" {
+		return errors.Errorf("address is required")
+	}
+	if a.Weight < 1 {
+		return errors.Errorf("address %q: weight must be positive, remove the address to take it out of rotation", a.Address)
+	}
+	return nil
+}
+
+// DefaultStickyCookie is the name of the sticky session cookie when not
+// configured.
+const DefaultStickyCookie = "sx_sticky"
+
+// Sticky configures cookie-based sticky sessions: the gateway issues a
+// cookie naming the backend chosen for a request, signed with Secret, and
+// later requests carrying it are sent to the same backend while it's
+// available. TTL sets the cookie max age; without it, the cookie lasts
+// for the browser session.
+type Sticky struct {
+	Cookie string        `yaml:"cookie"`
+	Secret string        `yaml:"secret"`
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+func (st *Sticky) clean() {
+	st.Cookie = strings.TrimSpace(st.Cookie)
+	if st.Cookie == "" {
+		st.Cookie = DefaultStickyCookie
+	}
+}
+
+func (st *Sticky) validate() error {
+	if st.Secret == "" {
+		return errors.Errorf("secret is required")
+	}
+	if st.TTL < 0 {
+		return errors.Errorf("ttl must be positive")
+	}
+	return nil
+}
+
+// Health check defaults.
+const (
+	DefaultHealthCheckPath               = "/"
+	DefaultHealthCheckInterval           = 10 * time.Second
+	DefaultHealthCheckTimeout            = 2 * time.Second
+	DefaultHealthCheckHealthyThreshold   = 2
+	DefaultHealthCheckUnhealthyThreshold = 3
+)
+
+// HealthCheck configures active health checking of service backends: each
+// backend is sent GET Path every Interval, and is considered unhealthy
+// after UnhealthyThreshold consecutive failures (errors, timeouts or
+// statuses other than 2xx/3xx), then healthy again after HealthyThreshold
+// consecutive successes.
+type HealthCheck struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthythreshold"`
+	UnhealthyThreshold int           `yaml:"unhealthythreshold"`
+}
+
+func (hc *HealthCheck) clean() {
+	hc.Path = strings.TrimSpace(hc.Path)
+	if hc.Path == "" {
+		hc.Path = DefaultHealthCheckPath
+	}
+	if hc.Interval == 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = DefaultHealthCheckTimeout
+		// shorter intervals cap the default timeout
+		if hc.Interval > 0 && hc.Timeout > hc.Interval {
+			hc.Timeout = hc.Interval
+		}
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = DefaultHealthCheckHealthyThreshold
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = DefaultHealthCheckUnhealthyThreshold
+	}
+}
+
+func (hc *HealthCheck) validate() error {
+	if !strings.HasPrefix(hc.Path, "/") {
+		return errors.Errorf("path must start with /")
+	}
+	if _, err := url.Parse(hc.Path); err != nil {
+		return errors.Wrap(err, "invalid path")
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return errors.Errorf("interval and timeout must be positive")
+	}
+	if hc.Timeout > hc.Interval {
+		return errors.Errorf("timeout must not be greater than interval")
+	}
+	if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return errors.Errorf("thresholds must be positive")
+	}
+	return nil
+}
+
+// Outlier detection defaults.
+const (
+	DefaultOutlierConsecutive5xx    = 5
+	DefaultOutlierConsecutiveErrors = 5
+	DefaultOutlierBaseEjectionTime  = 30 * time.Second
+	DefaultOutlierMaxEjectionTime   = 5 * time.Minute
+)
+
+// OutlierDetection configures passive health checking of service
+// backends: a backend returning Consecutive5xx 5xx responses or failing
+// ConsecutiveErrors requests in a row is ejected from load balancing. The
+// ejection lasts BaseEjectionTime, doubling on each further ejection up to
+// MaxEjectionTime; it's reset once the backend stays in rotation for
+// MaxEjectionTime.
+type OutlierDetection struct {
+	Consecutive5xx    int           `yaml:"consecutive5xx"`
+	ConsecutiveErrors int           `yaml:"consecutiveerrors"`
+	BaseEjectionTime  time.Duration `yaml:"baseejectiontime"`
+	MaxEjectionTime   time.Duration `yaml:"maxejectiontime"`
+}
+
+func (od *OutlierDetection) clean() {
+	if od.Consecutive5xx == 0 {
+		od.Consecutive5xx = DefaultOutlierConsecutive5xx
+	}
+	if od.ConsecutiveErrors == 0 {
+		od.ConsecutiveErrors = DefaultOutlierConsecutiveErrors
+	}
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = DefaultOutlierBaseEjectionTime
+	}
+	if od.MaxEjectionTime == 0 {
+		od.MaxEjectionTime = DefaultOutlierMaxEjectionTime
+	}
+}
+
+func (od *OutlierDetection) validate() error {
+	if od.Consecutive5xx < 0 || od.ConsecutiveErrors < 0 {
+		return errors.Errorf("thresholds must be positive")
+	}
+	if od.BaseEjectionTime < 0 || od.MaxEjectionTime < 0 {
+		return errors.Errorf("ejection times must be positive")
+	}
+	if od.BaseEjectionTime > od.MaxEjectionTime {
+		return errors.Errorf("baseejectiontime must not be greater than maxejectiontime")
+	}
+	return nil
+}
+
+// Circuit breaker defaults.
+const (
+	DefaultCircuitBreakerErrorRate        = 0.5
+	DefaultCircuitBreakerMinRequests      = 20
+	DefaultCircuitBreakerWindow           = 10 * time.Second
+	DefaultCircuitBreakerOpenDuration     = 30 * time.Second
+	DefaultCircuitBreakerHalfOpenRequests = 5
+)
+
+// CircuitBreaker configures a service circuit breaker. Requests failing
+// (with an error or a 5xx response) or, if Latency is set, slower than
+// Latency are counted over Window; once there are at least MinRequests
+// and the failed fraction reaches ErrorRate, the breaker opens and
+// requests are rejected for OpenDuration. It then lets HalfOpenRequests
+// requests through, closing again if they all succeed and reopening
+// otherwise.
+type CircuitBreaker struct {
+	ErrorRate        float64       `yaml:"errorrate"`
+	Latency          time.Duration `yaml:"latency"`
+	MinRequests      int           `yaml:"minrequests"`
+	Window           time.Duration `yaml:"window"`
+	OpenDuration     time.Duration `yaml:"openduration"`
+	HalfOpenRequests int           `yaml:"halfopenrequests"`
+}
+
+func (cb *CircuitBreaker) clean() {
+	if cb.ErrorRate == 0 {
+		cb.ErrorRate = DefaultCircuitBreakerErrorRate
+	}
+	if cb.MinRequests == 0 {
+		cb.MinRequests = DefaultCircuitBreakerMinRequests
+	}
+	if cb.Window == 0 {
+		cb.Window = DefaultCircuitBreakerWindow
+	}
+	if cb.OpenDuration == 0 {
+		cb.OpenDuration = DefaultCircuitBreakerOpenDuration
+	}
+	if cb.HalfOpenRequests == 0 {
+		cb.HalfOpenRequests = DefaultCircuitBreakerHalfOpenRequests
+	}
+}
+
+func (cb *CircuitBreaker) validate() error {
+	if cb.ErrorRate < 0 || cb.ErrorRate > 1 {
+		return errors.Errorf("errorrate must be between 0 and 1")
+	}
+	if cb.Latency < 0 || cb.Window < 0 || cb.OpenDuration < 0 {
+		return errors.Errorf("latency, window and openduration must be positive")
+	}
+	if cb.MinRequests < 0 || cb.HalfOpenRequests < 0 {
+		return errors.Errorf("minrequests and halfopenrequests must be positive")
+	}
+	return nil
+}
+
+// Retry defaults.
+const (
+	DefaultRetryAttempts   = 2
+	DefaultRetryBackoff    = 25 * time.Millisecond
+	DefaultRetryMaxBackoff = 250 * time.Millisecond
+)
+
+// Retry conditions other than upstream response status codes.
+const (
+	RetryOnConnectError = "connect_error"
+	RetryOnTimeout      = "timeout"
+)
+
+// DefaultRetryOn are the conditions retried when none are set.
+var DefaultRetryOn = []string{RetryOnConnectError, "502", "503", "504"}
+
+// DefaultRetryMethods are the methods retried when none are set: the
+// idempotent ones.
+var DefaultRetryMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+// Retry configures retries of failed upstream requests, up to Attempts
+// attempts in total, each sent to the next backend of the service. On
+// lists the conditions to retry: connect_error (the backend couldn't be
+// reached), timeout (PerTryTimeout elapsed before the response headers)
+// and response status codes. Retries wait a random backoff between 0 and
+// Backoff, doubling on each attempt up to MaxBackoff.
+type Retry struct {
+	Attempts      int           `yaml:"attempts"`
+	On            []string      `yaml:"on"`
+	Methods       []string      `yaml:"methods"`
+	PerTryTimeout time.Duration `yaml:"pertrytimeout"`
+	Backoff       time.Duration `yaml:"backoff"`
+	MaxBackoff    time.Duration `yaml:"maxbackoff"`
+}
+
+func (r *Retry) clean() {
+	if r.Attempts == 0 {
+		r.Attempts = DefaultRetryAttempts
+	}
+	if len(r.On) == 0 {
+		r.On = append([]string(nil), DefaultRetryOn...)
+	}
+	for i, on := range r.On {
+		r.On[i] = strings.ToLower(strings.TrimSpace(on))
+	}
+	if len(r.Methods) == 0 {
+		r.Methods = append([]string(nil), DefaultRetryMethods...)
+	}
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+	if r.Backoff == 0 {
+		r.Backoff = DefaultRetryBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = DefaultRetryMaxBackoff
+	}
+}
+
+func (r *Retry) validate() error {
+	if r.Attempts < 1 {
+		return errors.Errorf("attempts must be at least 1")
+	}
+	for _, on := range r.On {
+		if on == RetryOnConnectError || on == RetryOnTimeout {
+			continue
+		}
+		if code, err := strconv.Atoi(on); err != nil || code < 500 || code > 599 {
+			return errors.Errorf("unknown retry condition %q", on)
+		}
+	}
+	if r.PerTryTimeout < 0 || r.Backoff < 0 || r.MaxBackoff < 0 {
+		return errors.Errorf("pertrytimeout, backoff and maxbackoff must be positive")
+	}
+	if r.Backoff > r.MaxBackoff {
+		return errors.Errorf("backoff must not be greater than maxbackoff")
+	}
+	return nil
+}
+
+// RetriesMethod reports whether requests with method may be retried.
+func (r *Retry) RetriesMethod(method string) bool {
+	return contains(r.Methods, method)
+}
+
+// RetriesOn reports whether the condition (one of the RetryOn constants
+// or a status code) is retried.
+func (r *Retry) RetriesOn(condition string) bool {
+	return contains(r.On, condition)
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Hedge configures request hedging: once a request hasn't got the
+// response headers within Delay, it's sent again to another backend, and
+// whichever response arrives first is used. With Percentile, the delay is
+// that percentile of the latency of the route's successful upstream
+// responses over the last minute or two, but at least Delay; Delay alone
+// is used until enough responses were measured. Only Methods (by default,
+// the idempotent ones) are hedged.
+type Hedge struct {
+	Delay      time.Duration `yaml:"delay"`
+	Percentile float64       `yaml:"percentile"`
+	Methods    []string      `yaml:"methods"`
+}
+
+func (h *Hedge) clean() {
+	if len(h.Methods) == 0 {
+		h.Methods = append([]string(nil), DefaultRetryMethods...)
+	}
+	for i, m := range h.Methods {
+		h.Methods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+}
+
+func (h *Hedge) validate() error {
+	if h.Delay < 0 {
+		return errors.Errorf("delay must be positive")
+	}
+	if h.Percentile < 0 || h.Percentile >= 1 {
+		return errors.Errorf("percentile must be between 0 and 1")
+	}
+	if h.Delay == 0 && h.Percentile == 0 {
+		return errors.Errorf("hedge needs a delay or a percentile")
+	}
+	return nil
+}
+
+// HedgesMethod reports whether requests with method may be hedged.
+func (h *Hedge) HedgesMethod(method string) bool {
+	return contains(h.Methods, method)
+}
+
+// Timeout defaults, also used by routes without timeouts.
+const (
+	DefaultTimeoutConnect = 5 * time.Second
+	DefaultTimeoutHeader  = time.Minute
+)
+
+// Timeout bounds the time spent on upstream requests: Connect to
+// establish a connection to a backend, Header to receive the response
+// headers once the request is sent (for each attempt, when retried), and
+// Total for the whole request, including retries and the response body.
+// Total is disabled when unset.
+type Timeout struct {
+	Connect time.Duration `yaml:"connect"`
+	Header  time.Duration `yaml:"header"`
+	Total   time.Duration `yaml:"total"`
+}
+
+func (t *Timeout) clean() {
+	if t.Connect == 0 {
+		t.Connect = DefaultTimeoutConnect
+	}
+	if t.Header == 0 {
+		t.Header = DefaultTimeoutHeader
+	}
+}
+
+func (t *Timeout) validate() error {
+	if t.Connect < 0 || t.Header < 0 || t.Total < 0 {
+		return errors.Errorf("timeouts must be positive")
+	}
+	return nil
+}
+
 type RouteGroup struct {
 	ParentService *Service    `yaml:"-"`
 	Parent        *RouteGroup `yaml:"-"`
@@ -132,9 +754,15 @@ type RouteGroup struct {
 	Path   string         `yaml:"path"`
 	Routes *[]*RouteGroup `yaml:"routes"`
 
+	// MaxBodyBytes limits the size of request bodies, if positive.
+	MaxBodyBytes int64 `yaml:"maxbodybytes"`
+
 	Auth      *Auth      `yaml:"auth"`
 	Cache     *Cache     `yaml:"cache"`
 	RateLimit *RateLimit `yaml:"ratelimit"`
+	Retry     *Retry     `yaml:"retry"`
+	Timeout   *Timeout   `yaml:"timeout"`
+	Hedge     *Hedge     `yaml:"hedge"`
 }
 
 func (rg *RouteGroup) clean() {
@@ -150,6 +778,15 @@ func (rg *RouteGroup) clean() {
 	if rg.RateLimit != nil {
 		rg.RateLimit.clean()
 	}
+	if rg.Retry != nil {
+		rg.Retry.clean()
+	}
+	if rg.Timeout != nil {
+		rg.Timeout.clean()
+	}
+	if rg.Hedge != nil {
+		rg.Hedge.clean()
+	}
 	if rg.Routes == nil {
 		return
 	}
@@ -159,6 +796,9 @@ func (rg *RouteGroup) clean() {
 }
 
 func (rg *RouteGroup) validate(conf *GatewayConfig) error {
+	if rg.MaxBodyBytes < 0 {
+		return errors.Errorf("route %q maxbodybytes must not be negative", rg.Name)
+	}
 	if rg.Auth != nil {
 		if err := rg.Auth.validate(conf); err != nil {
 			return errors.Wrapf(err, "route %q can't validate auth", rg.Name)
@@ -174,6 +814,21 @@ func (rg *RouteGroup) validate(conf *GatewayConfig) error {
 			return errors.Wrapf(err, "route %q can't validate ratelimit", rg.Name)
 		}
 	}
+	if rg.Retry != nil {
+		if err := rg.Retry.validate(); err != nil {
+			return errors.Wrapf(err, "route %q can't validate retry", rg.Name)
+		}
+	}
+	if rg.Timeout != nil {
+		if err := rg.Timeout.validate(); err != nil {
+			return errors.Wrapf(err, "route %q can't validate timeout", rg.Name)
+		}
+	}
+	if rg.Hedge != nil {
+		if err := rg.Hedge.validate(); err != nil {
+			return errors.Wrapf(err, "route %q can't validate hedge", rg.Name)
+		}
+	}
 	if rg.Routes == nil {
 		return nil
 	}
@@ -293,6 +948,7 @@ func (ab *AuthBearer) Verify(token string) error {
 type CacheKey struct {
 	Header *string `yaml:"header"`
 	Query  *string `yaml:"query"`
+	Cookie *string `yaml:"cookie"`
 }
 
 func (ck *CacheKey) clean() {
@@ -302,6 +958,9 @@ func (ck *CacheKey) clean() {
 	if ck.Query != nil {
 		*ck.Query = strings.TrimSpace(*ck.Query)
 	}
+	if ck.Cookie != nil {
+		*ck.Cookie = strings.TrimSpace(*ck.Cookie)
+	}
 }
 
 func (ck *CacheKey) validate() error {
@@ -312,6 +971,7 @@ func (ck *CacheKey) validate() error {
 type CacheKeyExtractor interface {
 	ExtractHeader(name string) string
 	ExtractQuery(name string) string
+	ExtractCookie(name string) string
 }
 
 type CacheKeySet []CacheKey
@@ -325,6 +985,9 @@ func (cc CacheKeySet) Extract(x CacheKeyExtractor) (ks []string) {
 		if c.Query != nil {
 			ks = append(ks, x.ExtractQuery(*c.Query))
 		}
+		if c.Cookie != nil {
+			ks = append(ks, x.ExtractCookie(*c.Cookie))
+		}
 	}
 	return
 }
@@ -342,9 +1005,6 @@ func (c *Cache) clean() {
 }
 
 func (c *Cache) validate(conf *GatewayConfig) error {
-	if !conf.Redis.configured() {
-		return errors.Errorf("cache and ratelimit require redis")
-	}
 	if c.TTL.Seconds() < 1 {
 		return errors.Errorf("cache ttl must be greater than 1s")
 	}
@@ -357,7 +1017,17 @@ func (c *Cache) validate(conf *GatewayConfig) error {
 	return nil
 }
 
+// Rate limit algorithms.
+const (
+	RateLimitFixedWindow   = "fixed_window"
+	RateLimitSlidingWindow = "sliding_window"
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitGCRA          = "gcra"
+)
+
 type RateLimit struct {
+	Algorithm string     `yaml:"algorithm"`
+	Burst     *int       `yaml:"burst"`
 	PerDay    *int       `yaml:"day"`
 	PerHour   *int       `yaml:"hour"`
 	PerMinute *int       `yaml:"minute"`
@@ -366,6 +1036,10 @@ type RateLimit struct {
 }
 
 func (rl *RateLimit) clean() {
+	rl.Algorithm = strings.ToLower(strings.TrimSpace(rl.Algorithm))
+	if rl.Algorithm == "" {
+		rl.Algorithm = RateLimitFixedWindow
+	}
 	for i, k := range rl.Keys {
 		k.clean()
 		rl.Keys[i] = k
@@ -373,15 +1047,33 @@ func (rl *RateLimit) clean() {
 }
 
 func (rl *RateLimit) validate(conf *GatewayConfig) error {
-	if !conf.Redis.configured() {
-		return errors.Errorf("cache and ratelimit require redis")
-	}
 	if rl.PerDay == nil && rl.PerHour == nil && rl.PerMinute == nil && rl.PerSecond == nil {
 		return errors.Errorf("ratelimit needs at least one of day, hour, minute or second")
 	}
-	if *rl.PerDay == 0 && *rl.PerHour == 0 && *rl.PerMinute == 0 && *rl.PerSecond == 0 {
+	if len(rl.Windows()) == 0 {
 		return errors.Errorf("ratelimit needs at least one of day, hour, minute or second")
 	}
+	for _, w := range rl.Windows() {
+		if w.Limit < 0 {
+			return errors.Errorf("ratelimit values must not be negative")
+		}
+		// stores count time in microseconds
+		if w.Period/time.Duration(w.Limit) < time.Microsecond {
+			return errors.Errorf("ratelimit of %d per %s allows more than one request per microsecond", w.Limit, w.Period)
+		}
+	}
+	switch rl.Algorithm {
+	case RateLimitFixedWindow, RateLimitSlidingWindow:
+		if rl.Burst != nil {
+			return errors.Errorf("ratelimit burst is only supported by %s and %s", RateLimitTokenBucket, RateLimitGCRA)
+		}
+	case RateLimitTokenBucket, RateLimitGCRA:
+		if rl.Burst != nil && *rl.Burst < 1 {
+			return errors.Errorf("ratelimit burst must be at least 1")
+		}
+	default:
+		return errors.Errorf("unknown ratelimit algorithm %q", rl.Algorithm)
+	}
 	for _, k := range rl.Keys {
 		if err := k.validate(); err != nil {
 			return errors.Wrap(err, "rate limit can't validate cache key")
@@ -390,9 +1082,44 @@ func (rl *RateLimit) validate(conf *GatewayConfig) error {
 	return nil
 }
 
+// RateLimitWindow is a single limit applied over a period of time.
+// Burst is the number of requests that can be served at once by the
+// token_bucket and gcra algorithms.
+type RateLimitWindow struct {
+	Limit  int
+	Period time.Duration
+	Burst  int
+}
+
+// Windows returns the configured windows, from the longest to the shortest.
+// Unset and zero values are skipped. Burst defaults to the window limit;
+// a configured burst only applies to the shortest window.
+func (rl *RateLimit) Windows() (ws []RateLimitWindow) {
+	for _, w := range []struct {
+		limit  *int
+		period time.Duration
+	}{
+		{rl.PerDay, 24 * time.Hour},
+		{rl.PerHour, time.Hour},
+		{rl.PerMinute, time.Minute},
+		{rl.PerSecond, time.Second},
+	} {
+		if w.limit != nil && *w.limit != 0 {
+			ws = append(ws, RateLimitWindow{*w.limit, w.period, *w.limit})
+		}
+	}
+	if rl.Burst != nil && len(ws) > 0 {
+		ws[len(ws)-1].Burst = *rl.Burst
+	}
+	return
+}
+
 type Redis struct {
 	ReadAddresses  []string `yaml:"readaddresses"`
 	WriteAddresses []string `yaml:"writeaddresses"`
+
+	// Critical fails readiness when Redis is unreachable.
+	Critical bool `yaml:"critical"`
 }
 
 func (r *Redis) clean() {
@@ -413,7 +1140,8 @@ func (r *Redis) clean() {
 	r.WriteAddresses = wa
 }
 
-func (r *Redis) configured() bool {
+// Configured reports whether both read and write addresses are set.
+func (r *Redis) Configured() bool {
 	read := r.ReadAddresses != nil && len(r.ReadAddresses) > 0
 	write := r.WriteAddresses != nil && len(r.WriteAddresses) > 0
 	return read && write
@@ -423,3 +1151,113 @@ func (r *Redis) validate() error {
 	// TODO: validate they are absolute hosts
 	return nil
 }
+
+// DefaultMemoryCacheBytes is the in-memory cache size used when Redis
+// is not configured and no size is set.
+const DefaultMemoryCacheBytes = 64 << 20
+
+// Memory configures the in-memory store used when Redis is not configured.
+type Memory struct {
+	CacheBytes int64 `yaml:"cachebytes"`
+}
+
+func (m *Memory) clean() {
+	if m.CacheBytes == 0 {
+		m.CacheBytes = DefaultMemoryCacheBytes
+	}
+}
+
+func (m *Memory) validate() error {
+	if m.CacheBytes < 0 {
+		return errors.Errorf("memory cachebytes must not be negative")
+	}
+	return nil
+}
+
+// Retry budget defaults.
+const (
+	DefaultRetryBudgetRatio        = 0.2
+	DefaultRetryBudgetMinPerSecond = 10
+)
+
+// RetryBudget caps the retries of the whole gateway to Ratio of the
+// requests over the last 10 seconds, plus MinPerSecond retries per second
+// so that retries still work under low traffic. Unset fields default after
+// cleaning; explicit zeros are kept, so both at 0 disable retries.
+type RetryBudget struct {
+	Ratio        *float64 `yaml:"ratio"`
+	MinPerSecond *int     `yaml:"minpersecond"`
+}
+
+func (rb *RetryBudget) clean() {
+	if rb.Ratio == nil {
+		ratio := DefaultRetryBudgetRatio
+		rb.Ratio = &ratio
+	}
+	if rb.MinPerSecond == nil {
+		min := DefaultRetryBudgetMinPerSecond
+		rb.MinPerSecond = &min
+	}
+}
+
+func (rb *RetryBudget) validate() error {
+	if *rb.Ratio < 0 {
+		return errors.Errorf("ratio must not be negative")
+	}
+	if *rb.MinPerSecond < 0 {
+		return errors.Errorf("minpersecond must not be negative")
+	}
+	return nil
+}
+
+// DefaultDeadlineHeader is the deadline header used when none is set.
+const DefaultDeadlineHeader = "X-Request-Deadline"
+
+// Deadline configures deadline propagation. Clients can set Header (or
+// grpc-timeout) to the time left to serve their request, in milliseconds;
+// upstream requests are cancelled once it elapses, and get the time they
+// have left in the same header.
+type Deadline struct {
+	Header string `yaml:"header"`
+}
+
+func (d *Deadline) clean() {
+	d.Header = strings.TrimSpace(d.Header)
+	if d.Header == "" {
+		d.Header = DefaultDeadlineHeader
+	}
+}
+
+func (d *Deadline) validate() error {
+	if strings.ContainsAny(d.Header, " \t:") {
+		return errors.Errorf("invalid header name %q", d.Header)
+	}
+	return nil
+}
+
+// Error formats.
+const (
+	ErrorFormatJSON    = "json"
+	ErrorFormatProblem = "problem"
+)
+
+// Errors configures how errors are rendered: as Error JSON objects, or
+// as RFC 7807 problem details (application/problem+json) with the problem
+// format.
+type Errors struct {
+	Format string `yaml:"format"`
+}
+
+func (e *Errors) clean() {
+	e.Format = strings.ToLower(strings.TrimSpace(e.Format))
+	if e.Format == "" {
+		e.Format = ErrorFormatJSON
+	}
+}
+
+func (e *Errors) validate() error {
+	if e.Format != ErrorFormatJSON && e.Format != ErrorFormatProblem {
+		return errors.Errorf("unknown error format %q", e.Format)
+	}
+	return nil
+}
@@ -2,7 +2,10 @@ package sx
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestReadGatewayConfig(t *testing.T) {
@@ -31,7 +34,7 @@ func TestRedisCleanValidate(t *testing.T) {
 		t.Fatalf("invalid write address not removed")
 		return
 	}
-	if r.configured() {
+	if r.Configured() {
 		t.Fatalf("redis should NOT appear configured")
 		return
 	}
@@ -49,11 +52,11 @@ func TestCacheRateLimitCleanValidate(t *testing.T) {
 	r := &RateLimit{}
 	c.clean()
 	r.clean()
-	errRedisNotConfigured := "cache and ratelimit require redis"
-	if err := c.validate(conf); err == nil || err.Error() != errRedisNotConfigured {
+	// without redis, the in-memory store is used instead
+	if err := c.validate(conf); err == nil || err.Error() != "cache ttl must be greater than 1s" {
 		t.Errorf("bad validation error: %v", err)
 	}
-	if err := r.validate(conf); err == nil || err.Error() != errRedisNotConfigured {
+	if err := r.validate(conf); err == nil || err.Error() != "ratelimit needs at least one of day, hour, minute or second" {
 		t.Errorf("bad validation error: %v", err)
 	}
 	conf.Redis = redis
@@ -64,3 +67,400 @@ func TestCacheRateLimitCleanValidate(t *testing.T) {
 		t.Errorf("bad validation error: %v", err)
 	}
 }
+
+func TestConfigWarnings(t *testing.T) {
+	const services = `
+services:
+  - name: a
+    addresses: [localhost:8080]
+    routes:
+      - name: api
+        ratelimit:
+          minute: 10
+        routes:
+          - path: /users
+          - name: items
+            path: /items
+            cache:
+              ttl: 1m
+`
+	conf := new(GatewayConfig)
+	if err := conf.Read(strings.NewReader(services)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`route "api" uses cache or ratelimit without redis, state will be local to each replica`,
+		`route "items" uses cache or ratelimit without redis, state will be local to each replica`,
+	}
+	if w := conf.Warnings(); !reflect.DeepEqual(w, expected) {
+		t.Errorf("bad warnings: %q", w)
+	}
+	conf = new(GatewayConfig)
+	if err := conf.Read(strings.NewReader("redis:\n  readaddresses: [localhost:6379]\n  writeaddresses: [localhost:6379]" + services)); err != nil {
+		t.Fatal(err)
+	}
+	if w := conf.Warnings(); len(w) != 0 {
+		t.Errorf("unexpected warnings with redis: %q", w)
+	}
+}
+
+func TestRateLimitWindows(t *testing.T) {
+	zero, minute, second := 0, 30, 2
+	rl := &RateLimit{
+		PerHour:   &zero,
+		PerMinute: &minute,
+		PerSecond: &second,
+	}
+	rl.clean()
+	ws := rl.Windows()
+	if len(ws) != 2 {
+		t.Fatalf("unexpected windows: %v", ws)
+	}
+	if ws[0].Limit != 30 || ws[0].Period != time.Minute || ws[0].Burst != 30 {
+		t.Errorf("bad minute window: %v", ws[0])
+	}
+	if ws[1].Limit != 2 || ws[1].Period != time.Second {
+		t.Errorf("bad second window: %v", ws[1])
+	}
+	conf := &GatewayConfig{
+		Redis: Redis{
+			ReadAddresses:  []string{"localhost:6379"},
+			WriteAddresses: []string{"localhost:6379"},
+		},
+	}
+	if err := rl.validate(conf); err != nil {
+		t.Errorf("bad validation error: %v", err)
+	}
+	rl = &RateLimit{PerHour: &zero}
+	if err := rl.validate(conf); err == nil || err.Error() != "ratelimit needs at least one of day, hour, minute or second" {
+		t.Errorf("bad validation error: %v", err)
+	}
+	fast := 2000000
+	rl = &RateLimit{PerSecond: &fast}
+	rl.clean()
+	if err := rl.validate(conf); err == nil || err.Error() != "ratelimit of 2000000 per 1s allows more than one request per microsecond" {
+		t.Errorf("bad validation error: %v", err)
+	}
+}
+
+func TestRateLimitAlgorithmValidate(t *testing.T) {
+	conf := &GatewayConfig{
+		Redis: Redis{
+			ReadAddresses:  []string{"localhost:6379"},
+			WriteAddresses: []string{"localhost:6379"},
+		},
+	}
+	minute, second, burst := 60, 5, 20
+	rl := &RateLimit{PerMinute: &minute, PerSecond: &second}
+	rl.clean()
+	if rl.Algorithm != RateLimitFixedWindow {
+		t.Errorf("bad default algorithm: %q", rl.Algorithm)
+	}
+	rl.Burst = &burst
+	if err := rl.validate(conf); err == nil {
+		t.Errorf("burst should not be allowed with %s", rl.Algorithm)
+	}
+	rl.Algorithm = " Token_Bucket "
+	rl.clean()
+	if err := rl.validate(conf); err != nil {
+		t.Errorf("bad validation error: %v", err)
+	}
+	ws := rl.Windows()
+	if ws[0].Burst != 60 || ws[1].Burst != 20 {
+		t.Errorf("bad window bursts: %v", ws)
+	}
+	rl.Algorithm = "leaky_bucket"
+	if err := rl.validate(conf); err == nil || err.Error() != "unknown ratelimit algorithm \"leaky_bucket\"" {
+		t.Errorf("bad validation error: %v", err)
+	}
+}
+
+func TestHealthCheckCleanValidate(t *testing.T) {
+	hc := &HealthCheck{}
+	hc.clean()
+	if err := hc.validate(); err != nil {
+		t.Errorf("defaults should be valid: %v", err)
+	}
+	if hc.Path != "/" || hc.Interval != DefaultHealthCheckInterval || hc.Timeout != DefaultHealthCheckTimeout ||
+		hc.HealthyThreshold != DefaultHealthCheckHealthyThreshold || hc.UnhealthyThreshold != DefaultHealthCheckUnhealthyThreshold {
+		t.Errorf("bad defaults: %+v", hc)
+	}
+	hc = &HealthCheck{Interval: time.Second}
+	hc.clean()
+	if err := hc.validate(); err != nil || hc.Timeout != time.Second {
+		t.Errorf("default timeout not capped to a short interval: %v %+v", err, hc)
+	}
+	for _, c := range []struct {
+		hc  HealthCheck
+		err string
+	}{
+		{HealthCheck{Path: "healthz"}, "path must start with /"},
+		{HealthCheck{Interval: -time.Second}, "interval and timeout must be positive"},
+		{HealthCheck{Interval: time.Second, Timeout: 2 * time.Second}, "timeout must not be greater than interval"},
+		{HealthCheck{UnhealthyThreshold: -1}, "thresholds must be positive"},
+	} {
+		c.hc.clean()
+		if err := c.hc.validate(); err == nil || err.Error() != c.err {
+			t.Errorf("bad validation error for %+v: %v", c.hc, err)
+		}
+	}
+}
+
+func TestOutlierDetectionCleanValidate(t *testing.T) {
+	od := &OutlierDetection{}
+	od.clean()
+	if err := od.validate(); err != nil {
+		t.Errorf("defaults should be valid: %v", err)
+	}
+	for _, c := range []struct {
+		od  OutlierDetection
+		err string
+	}{
+		{OutlierDetection{Consecutive5xx: -1}, "thresholds must be positive"},
+		{OutlierDetection{BaseEjectionTime: -time.Second}, "ejection times must be positive"},
+		{OutlierDetection{BaseEjectionTime: time.Minute, MaxEjectionTime: time.Second}, "baseejectiontime must not be greater than maxejectiontime"},
+	} {
+		c.od.clean()
+		if err := c.od.validate(); err == nil || err.Error() != c.err {
+			t.Errorf("bad validation error for %+v: %v", c.od, err)
+		}
+	}
+}
+
+func TestCircuitBreakerCleanValidate(t *testing.T) {
+	cb := &CircuitBreaker{}
+	cb.clean()
+	if err := cb.validate(); err != nil {
+		t.Errorf("defaults should be valid: %v", err)
+	}
+	for _, c := range []struct {
+		cb  CircuitBreaker
+		err string
+	}{
+		{CircuitBreaker{ErrorRate: 1.5}, "errorrate must be between 0 and 1"},
+		{CircuitBreaker{Latency: -time.Second}, "latency, window and openduration must be positive"},
+		{CircuitBreaker{MinRequests: -1}, "minrequests and halfopenrequests must be positive"},
+	} {
+		c.cb.clean()
+		if err := c.cb.validate(); err == nil || err.Error() != c.err {
+			t.Errorf("bad validation error for %+v: %v", c.cb, err)
+		}
+	}
+}
+
+func TestRetryCleanValidate(t *testing.T) {
+	r := &Retry{On: []string{" Connect_Error ", "503"}, Methods: []string{"get"}}
+	r.clean()
+	if err := r.validate(); err != nil {
+		t.Errorf("defaults should be valid: %v", err)
+	}
+	if r.Attempts != DefaultRetryAttempts || !r.RetriesOn(RetryOnConnectError) || r.RetriesOn("502") {
+		t.Errorf("bad cleaned retry: %+v", r)
+	}
+	if !r.RetriesMethod("GET") || r.RetriesMethod("POST") {
+		t.Errorf("bad retried methods: %v", r.Methods)
+	}
+	r = &Retry{}
+	r.clean()
+	if !r.RetriesMethod("PUT") || r.RetriesMethod("POST") {
+		t.Errorf("only idempotent methods should be retried by default: %v", r.Methods)
+	}
+	for _, c := range []struct {
+		r   Retry
+		err string
+	}{
+		{Retry{Attempts: -1}, "attempts must be at least 1"},
+		{Retry{On: []string{"404"}}, `unknown retry condition "404"`},
+		{Retry{On: []string{"reset"}}, `unknown retry condition "reset"`},
+		{Retry{PerTryTimeout: -time.Second}, "pertrytimeout, backoff and maxbackoff must be positive"},
+		{Retry{Backoff: time.Second}, "backoff must not be greater than maxbackoff"},
+	} {
+		c.r.clean()
+		if err := c.r.validate(); err == nil || err.Error() != c.err {
+			t.Errorf("bad validation error for %+v: %v", c.r, err)
+		}
+	}
+}
+
+func TestRetryBudgetCleanValidate(t *testing.T) {
+	for _, c := range []struct {
+		yaml         string
+		ratio        float64
+		minPerSecond int
+	}{
+		{"", DefaultRetryBudgetRatio, DefaultRetryBudgetMinPerSecond},
+		{"retrybudget: {ratio: 0.5}", 0.5, DefaultRetryBudgetMinPerSecond},
+		{"retrybudget: {ratio: 0}", 0, DefaultRetryBudgetMinPerSecond},
+		{"retrybudget: {ratio: 0, minpersecond: 0}", 0, 0},
+	} {
+		conf := new(GatewayConfig)
+		if err := conf.Read(strings.NewReader("services: []\n" + c.yaml)); err != nil {
+			t.Fatal(err)
+		}
+		if rb := conf.RetryBudget; *rb.Ratio != c.ratio || *rb.MinPerSecond != c.minPerSecond {
+			t.Errorf("%q: bad retry budget: %v %v", c.yaml, *rb.Ratio, *rb.MinPerSecond)
+		}
+	}
+	conf := new(GatewayConfig)
+	if err := conf.Read(strings.NewReader("retrybudget: {minpersecond: -1}")); err == nil || !strings.HasSuffix(err.Error(), "minpersecond must not be negative") {
+		t.Errorf("bad validation error: %v", err)
+	}
+}
+
+func TestHedgeCleanValidate(t *testing.T) {
+	h := &Hedge{Delay: time.Millisecond}
+	h.clean()
+	if err := h.validate(); err != nil {
+		t.Errorf("defaults should be valid: %v", err)
+	}
+	if !h.HedgesMethod("GET") || h.HedgesMethod("POST") {
+		t.Errorf("only idempotent methods should be hedged by default: %v", h.Methods)
+	}
+	for _, c := range []struct {
+		h   Hedge
+		err string
+	}{
+		{Hedge{}, "hedge needs a delay or a percentile"},
+		{Hedge{Delay: -time.Second}, "delay must be positive"},
+		{Hedge{Percentile: 1}, "percentile must be between 0 and 1"},
+	} {
+		c.h.clean()
+		if err := c.h.validate(); err == nil || err.Error() != c.err {
+			t.Errorf("bad validation error for %+v: %v", c.h, err)
+		}
+	}
+}
+
+func TestTimeoutInheritance(t *testing.T) {
+	conf := new(GatewayConfig)
+	err := conf.Read(strings.NewReader(`
+services:
+  - name: a
+    addresses: [localhost:8080]
+    routes:
+      - name: api
+        timeout:
+          total: 30s
+        routes:
+          - path: /slow
+            timeout:
+              header: 2m
+          - path: /fast
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := *conf.Services[0].Routes[0].Routes
+	if expected := (Timeout{DefaultTimeoutConnect, 2 * time.Minute, 0}); *routes[0].Timeout != expected {
+		t.Errorf("bad overridden timeout: %+v", *routes[0].Timeout)
+	}
+	if expected := (Timeout{DefaultTimeoutConnect, DefaultTimeoutHeader, 30 * time.Second}); *routes[1].Timeout != expected {
+		t.Errorf("bad inherited timeout: %+v", *routes[1].Timeout)
+	}
+	if err := (&Timeout{Total: -time.Second}).validate(); err == nil || err.Error() != "timeouts must be positive" {
+		t.Errorf("bad validation error: %v", err)
+	}
+	if conf.Deadline.Header != DefaultDeadlineHeader {
+		t.Errorf("bad default deadline header: %q", conf.Deadline.Header)
+	}
+	if err := (&Deadline{Header: "X-Deadline:"}).validate(); err == nil || err.Error() != `invalid header name "X-Deadline:"` {
+		t.Errorf("bad validation error: %v", err)
+	}
+}
+
+func TestErrorsCleanValidate(t *testing.T) {
+	conf := new(GatewayConfig)
+	err := conf.Read(strings.NewReader(`
+services:
+  - name: a
+    addresses: [localhost:8080]
+    routes:
+      - name: api
+        maxbodybytes: 1024
+        routes:
+          - path: /upload
+            maxbodybytes: 1048576
+          - path: /items
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Errors.Format != ErrorFormatJSON {
+		t.Errorf("bad default error format: %q", conf.Errors.Format)
+	}
+	routes := *conf.Services[0].Routes[0].Routes
+	if routes[0].MaxBodyBytes != 1048576 || routes[1].MaxBodyBytes != 1024 {
+		t.Errorf("bad max body sizes: %d, %d", routes[0].MaxBodyBytes, routes[1].MaxBodyBytes)
+	}
+	e := &Errors{Format: " Problem"}
+	e.clean()
+	if err := e.validate(); err != nil || e.Format != ErrorFormatProblem {
+		t.Errorf("problem format should be valid: %q %v", e.Format, err)
+	}
+	if err := (&Errors{Format: "xml"}).validate(); err == nil || err.Error() != `unknown error format "xml"` {
+		t.Errorf("bad validation error: %v", err)
+	}
+	if err := (&RouteGroup{Name: "api", MaxBodyBytes: -1}).validate(conf); err == nil || err.Error() != `route "api" maxbodybytes must not be negative` {
+		t.Errorf("bad validation error: %v", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	if id := RequestID("abc"); id != "abc" {
+		t.Errorf("client request ID not kept: %q", id)
+	}
+	if id := RequestID("req_1.A-b"); id != "req_1.A-b" {
+		t.Errorf("client request ID not kept: %q", id)
+	}
+	a, b := RequestID(""), RequestID(strings.Repeat("a", maxRequestIDLength+1))
+	if len(a) != 32 || len(b) != 32 || a == b {
+		t.Errorf("bad generated request IDs: %q, %q", a, b)
+	}
+	for _, client := range []string{"a b", "a\r\nX-Injected: 1", "a\x00", "é", "a/b", "<script>"} {
+		if id := RequestID(client); id == client || len(id) != 32 {
+			t.Errorf("unsafe request ID %q not replaced: %q", client, id)
+		}
+	}
+}
+
+func TestServiceAddresses(t *testing.T) {
+	conf := new(GatewayConfig)
+	err := conf.Read(strings.NewReader(`
+services:
+  - name: a
+    loadbalancer: Weighted_Round_Robin
+    addresses:
+      - " localhost:8080 "
+      - address: localhost:8081
+        weight: 3
+      - address: localhost:8082
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := conf.Services[0]
+	expected := []Address{{"localhost:8080", 1}, {"localhost:8081", 3}, {"localhost:8082", 1}}
+	if !reflect.DeepEqual(svc.Addresses, expected) {
+		t.Errorf("bad addresses: %+v", svc.Addresses)
+	}
+	if svc.LoadBalancer != LoadBalancerWeightedRoundRobin {
+		t.Errorf("bad loadbalancer: %q", svc.LoadBalancer)
+	}
+
+	for yml, msg := range map[string]string{
+		"addresses: [{address: localhost, wieght: 3}]":                         "error decoding yaml",
+		"addresses: [{address: localhost, weight: -1}]":                        `in service "a": address "localhost": weight must be positive`,
+		"addresses: [{address: localhost, weight: 0}]":                         `in service "a": address "localhost": weight must be positive`,
+		"addresses: [localhost]\n    loadbalancer: magic":                      `in service "a": unknown loadbalancer "magic"`,
+		"addresses: [localhost]\n    loadbalancer: hash":                       `in service "a": the hash loadbalancer needs hash`,
+		"addresses: [localhost]\n    loadbalancer: hash\n    hash: {keys: []}": `in service "a": hash needs at least one key`,
+		"addresses: [localhost]\n    slowstart: -1s":                           `in service "a": slowstart must be positive`,
+		"addresses: [localhost]\n    sticky: {ttl: 1h}":                        `in service "a": can't validate sticky: secret is required`,
+		"addresses: [localhost]\n    hash: {keys: [{cookie: session}]}":        `in service "a": hash is only supported by the hash loadbalancer`,
+	} {
+		err := new(GatewayConfig).Read(strings.NewReader("services:\n  - name: a\n    " + yml))
+		if err == nil || !strings.HasPrefix(err.Error(), msg) {
+			t.Errorf("bad error for %q: %v", yml, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package sx
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigDiff lists the services and routes added, removed or changed
+// between two configurations. Routes are identified by method and pattern.
+type ConfigDiff struct {
+	ServicesAdded   []string
+	ServicesRemoved []string
+	ServicesChanged []string
+	RoutesAdded     []string
+	RoutesRemoved   []string
+	RoutesChanged   []string
+}
+
+// Empty reports whether the configurations are equivalent.
+func (d ConfigDiff) Empty() bool {
+	return len(d.ServicesAdded)+len(d.ServicesRemoved)+len(d.ServicesChanged)+
+		len(d.RoutesAdded)+len(d.RoutesRemoved)+len(d.RoutesChanged) == 0
+}
+
+func (d ConfigDiff) String() string {
+	var parts []string
+	for _, l := range []struct {
+		name  string
+		items []string
+	}{
+		{"services added", d.ServicesAdded},
+		{"services removed", d.ServicesRemoved},
+		{"services changed", d.ServicesChanged},
+		{"routes added", d.RoutesAdded},
+		{"routes removed", d.RoutesRemoved},
+		{"routes changed", d.RoutesChanged},
+	} {
+		if len(l.items) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", l.name, strings.Join(l.items, ", ")))
+		}
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// DiffConfig compares two configurations; old may be nil.
+func DiffConfig(old, new *GatewayConfig) (d ConfigDiff) {
+	oldSvcs, newSvcs := services(old), services(new)
+	d.ServicesAdded, d.ServicesRemoved, d.ServicesChanged = diffKeys(oldSvcs, newSvcs)
+	oldRoutes, newRoutes := routes(old), routes(new)
+	d.RoutesAdded, d.RoutesRemoved, d.RoutesChanged = diffKeys(oldRoutes, newRoutes)
+	return
+}
+
+// services returns the YAML representation of each service by name.
+func services(conf *GatewayConfig) map[string]string {
+	m := make(map[string]string)
+	if conf == nil {
+		return m
+	}
+	for _, svc := range conf.Services {
+		b, _ := yaml.Marshal(svc)
+		m[svc.Name] = string(b)
+	}
+	return m
+}
+
+// routes returns the YAML representation of each route by method and
+// pattern, including inherited settings but not child routes.
+func routes(conf *GatewayConfig) map[string]string {
+	m := make(map[string]string)
+	if conf == nil {
+		return m
+	}
+	for _, svc := range conf.Services {
+		rs, err := svc.CompileRoutes()
+		if err != nil {
+			continue
+		}
+		for _, r := range rs {
+			rg := *r.RouteGroup
+			rg.Routes = nil
+			b, _ := yaml.Marshal(&rg)
+			method := rg.Method
+			if method == "" {
+				method = "*"
+			}
+			m[fmt.Sprintf("%s %s", method, r.Pattern)] = string(b)
+		}
+	}
+	return m
+}
+
+func diffKeys(old, new map[string]string) (added, removed, changed []string) {
+	for k, v := range new {
+		if ov, ok := old[k]; !ok {
+			added = append(added, k)
+		} else if ov != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return
+}
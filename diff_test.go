@@ -0,0 +1,69 @@
+package sx
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	read := func(s string) *GatewayConfig {
+		conf := new(GatewayConfig)
+		if err := conf.Read(strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+		return conf
+	}
+	old := read(`
+services:
+  - name: a
+    addresses: [localhost:8080]
+    routes:
+      - name: root
+        method: GET
+        path: /
+      - name: users
+        path: /users
+  - name: b
+    addresses: [localhost:8081]
+    routes:
+      - name: root
+        path: /*
+`)
+	new := read(`
+services:
+  - name: a
+    addresses: [localhost:8080]
+    routes:
+      - name: root
+        method: GET
+        path: /
+      - name: users
+        path: /users
+        cache:
+          ttl: 10s
+  - name: c
+    addresses: [localhost:8082]
+    routes:
+      - name: root
+        path: /*
+`)
+	d := DiffConfig(old, new)
+	expected := ConfigDiff{
+		ServicesAdded:   []string{"c"},
+		ServicesRemoved: []string{"b"},
+		ServicesChanged: []string{"a"},
+		RoutesAdded:     []string{"* /c/*"},
+		RoutesRemoved:   []string{"* /b/*"},
+		RoutesChanged:   []string{"* /a/users"},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("bad diff: %+v", d)
+	}
+	if d := DiffConfig(old, old); !d.Empty() || d.String() != "no changes" {
+		t.Errorf("bad diff: %+v", d)
+	}
+	if d := DiffConfig(nil, old); len(d.ServicesAdded) != 2 || len(d.RoutesAdded) != 3 {
+		t.Errorf("bad diff: %+v", d)
+	}
+}
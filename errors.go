@@ -1,13 +1,85 @@
 package sx
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Error is the JSON body of the responses of requests SX failed to serve.
+// RequestID identifies the request, as sent upstream and returned to the
+// client in the RequestIDHeader header.
 type Error struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 var (
-	ErrorNotFound   = Error{404, "not found"}
-	ErrorForbidden  = Error{401, "forbidden"}
-	ErrorBadMethod  = Error{405, "bad method"}
-	ErrorBadGateway = Error{502, "bad gateway"}
+	ErrorUnauthorized       = Error{Code: 401, Message: "unauthorized"}
+	ErrorForbidden          = Error{Code: 403, Message: "forbidden"}
+	ErrorNotFound           = Error{Code: 404, Message: "not found"}
+	ErrorBadMethod          = Error{Code: 405, Message: "bad method"}
+	ErrorPayloadTooLarge    = Error{Code: 413, Message: "payload too large"}
+	ErrorTooManyRequests    = Error{Code: 429, Message: "too many requests"}
+	ErrorBadGateway         = Error{Code: 502, Message: "bad gateway"}
+	ErrorServiceUnavailable = Error{Code: 503, Message: "service unavailable"}
+	ErrorGatewayTimeout     = Error{Code: 504, Message: "gateway timeout"}
 )
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Problem returns e as problem details about instance (the request path).
+func (e Error) Problem(instance string) Problem {
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(e.Code),
+		Status:    e.Code,
+		Detail:    e.Message,
+		Instance:  instance,
+		RequestID: e.RequestID,
+	}
+}
+
+// RequestIDHeader is the header carrying request IDs.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the length of the longest request ID accepted
+// from clients.
+const maxRequestIDLength = 128
+
+// NotLoadedRetryAfter is the Retry-After header, in seconds, of requests
+// answered with ErrorServiceUnavailable before a configuration is loaded.
+const NotLoadedRetryAfter = "1"
+
+// RequestID returns the request ID set by the client, if valid, or a new
+// random one. Valid IDs are at most maxRequestIDLength letters, digits,
+// dots, underscores and hyphens, so they are safe to log and forward.
+func RequestID(client string) string {
+	if client != "" && len(client) <= maxRequestIDLength && validRequestID(client) {
+		return client
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
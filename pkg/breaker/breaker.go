@@ -0,0 +1,224 @@
+// package breaker implements a circuit breaker.
+package breaker
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/trapped/sx"
+)
+
+var metricState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "sx",
+	Subsystem: "circuitbreaker",
+	Name:      "state",
+	Help:      "Circuit breaker state: 0 closed, 1 half-open, 2 open",
+}, []string{"service"})
+
+// owners maps services to the breaker reporting their state: the latest
+// one built, since a reload can rebuild a service's breaker while the
+// previous one drains.
+var owners = struct {
+	sync.Mutex
+	breakers map[string]*Breaker
+}{breakers: make(map[string]*Breaker)}
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets requests through, counting failures.
+	Closed State = iota
+	// HalfOpen lets a limited number of trial requests through.
+	HalfOpen
+	// Open rejects requests.
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	}
+	return "unknown"
+}
+
+// Outcome is the outcome of a request allowed by a Breaker.
+type Outcome int
+
+const (
+	// Success counts the request as successful.
+	Success Outcome = iota
+	// Failure counts the request as failed.
+	Failure
+	// Ignored doesn't count the request, only releasing its half-open
+	// trial, for requests that failed through no fault of the upstream
+	// (e.g. cancelled by the client).
+	Ignored
+)
+
+// Breaker is a circuit breaker for a service, as configured by
+// sx.CircuitBreaker.
+type Breaker struct {
+	name string
+	conf sx.CircuitBreaker
+	now  func() time.Time
+
+	mu    sync.Mutex
+	state State
+	// generation is incremented on each state change, so that outcomes of
+	// requests allowed in a previous state are ignored
+	generation uint64
+	// closed state
+	windowStart        time.Time
+	requests, failures int
+	// open state
+	openedAt time.Time
+	// half-open state
+	trials, successes int
+}
+
+// New returns a closed Breaker for the service name. It reports the
+// service state in place of previous breakers for the same service.
+func New(name string, conf sx.CircuitBreaker) *Breaker {
+	b := &Breaker{name: name, conf: conf, now: time.Now}
+	owners.Lock()
+	defer owners.Unlock()
+	owners.breakers[name] = b
+	metricState.WithLabelValues(name).Set(float64(Closed))
+	return b
+}
+
+// Close deletes the state series of the service, unless a newer breaker
+// reports it. The breaker must not be used afterwards.
+func (b *Breaker) Close() {
+	owners.Lock()
+	defer owners.Unlock()
+	if owners.breakers[b.name] == b {
+		delete(owners.breakers, b.name)
+		metricState.DeleteLabelValues(b.name)
+	}
+}
+
+// report sets the state series of the service, unless a newer breaker
+// reports it.
+func (b *Breaker) report(s State) {
+	owners.Lock()
+	defer owners.Unlock()
+	if owners.breakers[b.name] == b {
+		metricState.WithLabelValues(b.name).Set(float64(s))
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(b.now())
+	return b.state
+}
+
+// Failed reports whether a request should count as failed, given its
+// response status (0 if it failed with an error) and latency.
+func (b *Breaker) Failed(status int, latency time.Duration) bool {
+	return status == 0 || status >= 500 || (b.conf.Latency > 0 && latency > b.conf.Latency)
+}
+
+// Result returns the outcome of a request: Failure if it failed, as
+// reported by Failed, Success otherwise.
+func (b *Breaker) Result(status int, latency time.Duration) Outcome {
+	if b.Failed(status, latency) {
+		return Failure
+	}
+	return Success
+}
+
+// Allow reports whether a request may be sent upstream. If it may, done
+// must be called once with the outcome of the request.
+func (b *Breaker) Allow() (done func(Outcome), ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(b.now())
+	switch b.state {
+	case Open:
+		return nil, false
+	case HalfOpen:
+		if b.trials >= b.conf.HalfOpenRequests {
+			return nil, false
+		}
+		b.trials++
+	}
+	gen := b.generation
+	var once sync.Once
+	return func(o Outcome) {
+		once.Do(func() { b.done(gen, o) })
+	}, true
+}
+
+func (b *Breaker) done(gen uint64, o Outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.generation {
+		return
+	}
+	if o == Ignored {
+		if b.state == HalfOpen {
+			b.trials--
+		}
+		return
+	}
+	failed := o == Failure
+	now := b.now()
+	switch b.state {
+	case Closed:
+		if now.Sub(b.windowStart) >= b.conf.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.conf.MinRequests &&
+			float64(b.failures) >= b.conf.ErrorRate*float64(b.requests) {
+			b.set(Open, now)
+		}
+	case HalfOpen:
+		if failed {
+			b.set(Open, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.conf.HalfOpenRequests {
+			b.set(Closed, now)
+		}
+	}
+}
+
+// expire moves an open breaker to half-open once OpenDuration has passed.
+func (b *Breaker) expire(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.conf.OpenDuration {
+		b.set(HalfOpen, now)
+	}
+}
+
+func (b *Breaker) set(s State, now time.Time) {
+	log.Printf("circuit breaker for service %q %s -> %s", b.name, b.state, s)
+	b.state = s
+	b.generation++
+	switch s {
+	case Closed:
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	case Open:
+		b.openedAt = now
+	case HalfOpen:
+		b.trials, b.successes = 0, 0
+	}
+	b.report(s)
+}
@@ -0,0 +1,173 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/trapped/sx"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := New("test", sx.CircuitBreaker{
+		ErrorRate:        0.5,
+		MinRequests:      4,
+		Window:           10 * time.Second,
+		OpenDuration:     5 * time.Second,
+		HalfOpenRequests: 2,
+	})
+	b.now = func() time.Time { return now }
+	request := func(failed bool) bool {
+		done, ok := b.Allow()
+		if ok && failed {
+			done(Failure)
+		} else if ok {
+			done(Success)
+		}
+		return ok
+	}
+
+	// failures in an expired window don't count
+	request(true)
+	request(true)
+	now = now.Add(10 * time.Second)
+	request(false)
+	request(true)
+	request(false)
+	if b.State() != Closed {
+		t.Fatalf("breaker should be closed, is %s", b.State())
+	}
+	request(true)
+	if b.State() != Open {
+		t.Fatalf("breaker should be open, is %s", b.State())
+	}
+	if request(false) {
+		t.Errorf("open breaker allowed a request")
+	}
+
+	// half-open lets a limited number of trials through
+	now = now.Add(5 * time.Second)
+	if b.State() != HalfOpen {
+		t.Fatalf("breaker should be half-open, is %s", b.State())
+	}
+	done1, ok1 := b.Allow()
+	_, ok2 := b.Allow()
+	if _, ok3 := b.Allow(); !ok1 || !ok2 || ok3 {
+		t.Fatalf("half-open breaker should allow exactly 2 trials")
+	}
+	done1(Failure)
+	if b.State() != Open {
+		t.Fatalf("failed trial should reopen the breaker, is %s", b.State())
+	}
+
+	now = now.Add(5 * time.Second)
+	request(false)
+	request(false)
+	if b.State() != Closed {
+		t.Fatalf("successful trials should close the breaker, is %s", b.State())
+	}
+}
+
+func TestBreakerStaleOutcomes(t *testing.T) {
+	b := New("test", sx.CircuitBreaker{
+		ErrorRate:        1,
+		MinRequests:      1,
+		Window:           time.Minute,
+		OpenDuration:     time.Minute,
+		HalfOpenRequests: 1,
+	})
+	slow, _ := b.Allow()
+	done, _ := b.Allow()
+	done(Failure)
+	done(Failure) // only counted once
+	if b.State() != Open {
+		t.Fatalf("breaker should be open, is %s", b.State())
+	}
+	// a request allowed while closed completing after the breaker opened
+	// must not affect it
+	slow(Success)
+	if b.State() != Open {
+		t.Errorf("stale outcome changed breaker state to %s", b.State())
+	}
+}
+
+func TestBreakerIgnored(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := New("test", sx.CircuitBreaker{
+		ErrorRate:        1,
+		MinRequests:      1,
+		Window:           time.Minute,
+		OpenDuration:     time.Minute,
+		HalfOpenRequests: 1,
+	})
+	b.now = func() time.Time { return now }
+	done, _ := b.Allow()
+	done(Failure)
+	now = now.Add(time.Minute)
+	// cancelled trials neither close the breaker nor keep their slot
+	for i := 0; i < 3; i++ {
+		done, ok := b.Allow()
+		if !ok {
+			t.Fatalf("trial %d not allowed after an ignored one", i)
+		}
+		done(Ignored)
+		if b.State() != HalfOpen {
+			t.Fatalf("ignored trial changed breaker state to %s", b.State())
+		}
+	}
+	done, _ = b.Allow()
+	done(Success)
+	if b.State() != Closed {
+		t.Errorf("successful trial should close the breaker, is %s", b.State())
+	}
+}
+
+func TestBreakerFailed(t *testing.T) {
+	b := New("test", sx.CircuitBreaker{Latency: time.Second})
+	for _, c := range []struct {
+		status  int
+		latency time.Duration
+		failed  bool
+	}{
+		{0, 0, true},
+		{200, 0, false},
+		{404, 0, false},
+		{503, 0, true},
+		{200, 2 * time.Second, true},
+	} {
+		if b.Failed(c.status, c.latency) != c.failed {
+			t.Errorf("Failed(%d, %v) should be %v", c.status, c.latency, c.failed)
+		}
+		expected := Success
+		if c.failed {
+			expected = Failure
+		}
+		if b.Result(c.status, c.latency) != expected {
+			t.Errorf("Result(%d, %v) should be %v", c.status, c.latency, expected)
+		}
+	}
+}
+
+func TestBreakerStateOwnership(t *testing.T) {
+	conf := sx.CircuitBreaker{ErrorRate: 0.5, MinRequests: 1, Window: time.Second, OpenDuration: time.Second, HalfOpenRequests: 1}
+	old := New("owned", conf)
+	// a reload rebuilds the breaker while the old one drains
+	b := New("owned", conf)
+	done, _ := old.Allow()
+	done(Failure)
+	if old.State() != Open {
+		t.Fatalf("old breaker should be open, is %s", old.State())
+	}
+	if v := testutil.ToFloat64(metricState.WithLabelValues("owned")); v != float64(Closed) {
+		t.Errorf("draining breaker changed the state of its replacement: %v", v)
+	}
+	old.Close()
+	if v := testutil.ToFloat64(metricState.WithLabelValues("owned")); v != float64(Closed) {
+		t.Errorf("draining breaker deleted the state of its replacement: %v", v)
+	}
+	b.Close()
+	if metricState.DeleteLabelValues("owned") {
+		t.Errorf("state not deleted with the last breaker")
+	}
+}
@@ -2,46 +2,171 @@ package fasthttp
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/trapped/sx"
+	"github.com/trapped/sx/pkg/breaker"
+	"github.com/trapped/sx/pkg/lifecycle"
 	"github.com/trapped/sx/pkg/tricks"
 	"github.com/valyala/fasthttp"
 )
 
-type Gateway struct {
+// state is an immutable snapshot of the gateway runtime configuration.
+// Requests keep using the state they started with, even if a new one is
+// loaded in the meantime.
+type state struct {
+	conf           *sx.GatewayConfig
 	routes         []sx.Route
-	serviceBackend map[string]*fasthttp.HostClient
+	serviceBackend map[string]*hostClient
+	gen            *lifecycle.Generation
+}
+
+// hostClient is shared by all states loading the same service backends;
+// its idle connections are closed once no state uses it.
+type hostClient struct {
+	*fasthttp.HostClient
+	*lifecycle.Ref
+	svc     *sx.Service
+	breaker *breaker.Breaker
 }
 
-func (g *Gateway) match(path string) *sx.Route {
-	for i := 0; i < len(g.routes); i++ {
-		r := &g.routes[i]
-		if r.Match(path) {
-			return r
+func newHostClient(svc *sx.Service) *hostClient {
+	addrs := make([]string, len(svc.Addresses))
+	for i, addr := range svc.Addresses {
+		addrs[i] = addr.Address
+	}
+	c := &fasthttp.HostClient{
+		Addr:     strings.Join(addrs, ","),
+		MaxConns: 1000 * len(svc.Addresses),
+	}
+	hc := &hostClient{HostClient: c, svc: svc}
+	hc.Ref = lifecycle.NewRef(func() {
+		c.CloseIdleConnections()
+		if hc.breaker != nil {
+			hc.breaker.Close()
 		}
+	})
+	if svc.CircuitBreaker != nil {
+		hc.breaker = breaker.New(svc.Name, *svc.CircuitBreaker)
 	}
-	return nil
+	return hc
 }
 
-func writeError(ctx *fasthttp.RequestCtx, e sx.Error) {
-	ctx.SetContentType("application/json")
+// close releases the state resources.
+func (st *state) close() {
+	for _, c := range st.serviceBackend {
+		c.Release()
+	}
+}
+
+type Gateway struct {
+	// state holds the current *state, swapped atomically on reload
+	state atomic.Value
+	// mu guards s and serializes configuration loads
+	mu sync.Mutex
+	s  *fasthttp.Server
+}
+
+// current returns the currently loaded state, or nil if no configuration
+// was loaded yet.
+func (g *Gateway) current() *state {
+	st, _ := g.state.Load().(*state)
+	return st
+}
+
+// acquire returns the current state, which must be released once the
+// request is done with it. It returns nil if no configuration was loaded
+// yet.
+func (g *Gateway) acquire() *state {
+	for {
+		st := g.current()
+		if st == nil {
+			return nil
+		}
+		st.gen.Acquire()
+		if g.current() == st {
+			return st
+		}
+		// swapped in the meantime, the state may already be closed
+		st.gen.Release()
+	}
+}
+
+// match returns the first route matching method and path. If routes
+// match path but not method, it returns the methods they allow instead.
+func (st *state) match(method, path string) (rt *sx.Route, allowed []string) {
+	for i := 0; i < len(st.routes); i++ {
+		r := &st.routes[i]
+		if !r.Match(path) {
+			continue
+		}
+		if r.MatchMethod(method) {
+			return r, nil
+		}
+		if !contains(allowed, r.RouteGroup.Method) {
+			allowed = append(allowed, r.RouteGroup.Method)
+		}
+	}
+	return nil, allowed
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// originalPathKey is the user value key of the request path, before the
+// service prefix is stripped from it.
+type originalPathKey struct{}
+
+// writeError replies with e, in the error format of st (JSON if no
+// configuration was loaded yet).
+func writeError(ctx *fasthttp.RequestCtx, st *state, e sx.Error) {
+	e.RequestID = string(ctx.Request.Header.Peek(sx.RequestIDHeader))
+	ctx.Response.Header.Set(sx.RequestIDHeader, e.RequestID)
 	ctx.SetStatusCode(e.Code)
+	if st != nil && st.conf.Errors.Format == sx.ErrorFormatProblem {
+		instance, ok := ctx.UserValue(originalPathKey{}).(string)
+		if !ok {
+			instance = string(ctx.Path())
+		}
+		ctx.SetContentType("application/problem+json")
+		json.NewEncoder(ctx).Encode(e.Problem(instance))
+		return
+	}
+	ctx.SetContentType("application/json")
 	json.NewEncoder(ctx).Encode(e)
 }
 
-func parseAuthorization(t string, auth []byte) (username, password string) {
+// credentials returns the credentials of an Authorization header using
+// scheme t, if any.
+func credentials(t string, auth []byte) ([]byte, bool) {
 	i := bytes.IndexByte(auth, ' ')
-	if i == -1 {
-		return
+	if i == -1 || !bytes.EqualFold(auth[:i], tricks.StringToBytes(t)) || i+1 == len(auth) {
+		return nil, false
 	}
-	if !bytes.EqualFold(auth[:i], tricks.StringToBytes(t)) {
+	return auth[i+1:], true
+}
+
+func parseAuthorization(t string, auth []byte) (username, password string) {
+	encoded, ok := credentials(t, auth)
+	if !ok {
 		return
 	}
-	decoded, err := base64.StdEncoding.DecodeString(tricks.BytesToString(auth[i+1:]))
+	decoded, err := base64.StdEncoding.DecodeString(tricks.BytesToString(encoded))
 	if err != nil {
 		return
 	}
@@ -55,76 +180,190 @@ func parseAuthorization(t string, auth []byte) (username, password string) {
 	return
 }
 
-func (g *Gateway) authorize(rg *sx.RouteGroup, ctx *fasthttp.RequestCtx) bool {
+// authorize checks the credentials of the request against the route auth.
+// Requests without credentials fail with ErrorUnauthorized, along with
+// the challenge for the WWW-Authenticate header; requests whose
+// credentials are rejected fail with ErrorForbidden.
+func (g *Gateway) authorize(rg *sx.RouteGroup, ctx *fasthttp.RequestCtx) (e sx.Error, challenge string, ok bool) {
 	if rg.Auth == nil {
-		return true
+		return sx.Error{}, "", true
 	}
+	realm := strconv.Quote(rg.ParentService.Name)
+	auth := ctx.Request.Header.Peek("Authorization")
 	if rg.Auth.Basic != nil {
-		username, password := parseAuthorization("basic", ctx.Request.Header.Peek("Authorization"))
-		return rg.Auth.Basic.Verify(username, password)
+		if _, ok := credentials("basic", auth); !ok {
+			return sx.ErrorUnauthorized, "Basic realm=" + realm, false
+		}
+		username, password := parseAuthorization("basic", auth)
+		if !rg.Auth.Basic.Verify(username, password) {
+			return sx.ErrorForbidden, "", false
+		}
+		return sx.Error{}, "", true
 	}
 	if rg.Auth.Bearer != nil {
-		token, _ := parseAuthorization("bearer", ctx.Request.Header.Peek("Authorization"))
-		return rg.Auth.Bearer.Verify(token) == nil
+		token, ok := credentials("bearer", auth)
+		if !ok {
+			return sx.ErrorUnauthorized, "Bearer realm=" + realm, false
+		}
+		if rg.Auth.Bearer.Verify(string(token)) != nil {
+			return sx.ErrorForbidden, "", false
+		}
 	}
-	return true
+	return sx.Error{}, "", true
 }
 
 // ServeFastHTTP implements the valyala/fasthttp handler interface.
 func (g *Gateway) ServeFastHTTP(ctx *fasthttp.RequestCtx) {
-	rt := g.match(tricks.BytesToString(ctx.Path()))
-	if rt == nil || rt.RouteGroup == nil {
-		writeError(ctx, sx.ErrorNotFound)
+	// identify the request to the upstream and in the response
+	id := sx.RequestID(string(ctx.Request.Header.Peek(sx.RequestIDHeader)))
+	ctx.Request.Header.Set(sx.RequestIDHeader, id)
+	// pin the request to the current state
+	st := g.acquire()
+	if st == nil {
+		ctx.Response.Header.Set("Retry-After", sx.NotLoadedRetryAfter)
+		writeError(ctx, nil, sx.ErrorServiceUnavailable)
+		return
+	}
+	defer st.gen.Release()
+	rt, allowed := st.match(tricks.BytesToString(ctx.Method()), tricks.BytesToString(ctx.Path()))
+	if rt == nil && len(allowed) > 0 {
+		ctx.Response.Header.Set("Allow", strings.Join(allowed, ", "))
+		writeError(ctx, st, sx.ErrorBadMethod)
 		return
 	}
-	if !g.authorize(rt.RouteGroup, ctx) {
-		writeError(ctx, sx.ErrorForbidden)
+	if rt == nil {
+		writeError(ctx, st, sx.ErrorNotFound)
 		return
 	}
-	if rt.RouteGroup.Method != "" && tricks.BytesToString(ctx.Method()) != rt.RouteGroup.Method {
-		writeError(ctx, sx.ErrorBadMethod)
+	if e, challenge, ok := g.authorize(rt.RouteGroup, ctx); !ok {
+		if challenge != "" {
+			ctx.Response.Header.Set("WWW-Authenticate", challenge)
+		}
+		writeError(ctx, st, e)
+		return
+	}
+	if max := rt.RouteGroup.MaxBodyBytes; max > 0 && int64(len(ctx.Request.Body())) > max {
+		writeError(ctx, st, sx.ErrorPayloadTooLarge)
 		return
 	}
 	// TODO: check rate limit
 	// TODO: fetch from cache
 	// get next backend to proxy request to
-	backend := g.serviceBackend[rt.RouteGroup.ParentService.Name]
+	backend := st.serviceBackend[rt.RouteGroup.ParentService.Name]
 	// rewrite the URI
 	uri := ctx.URI()
+	ctx.SetUserValue(originalPathKey{}, string(uri.Path()))
 	uri.SetPathBytes(uri.Path()[len(rt.RouteGroup.ParentService.PathPrefix):])
+	// fail fast while the service circuit breaker is open
+	var done func(breaker.Outcome)
+	if backend.breaker != nil {
+		var ok bool
+		if done, ok = backend.breaker.Allow(); !ok {
+			writeError(ctx, st, sx.ErrorServiceUnavailable)
+			return
+		}
+	}
 	// wire up streams
 	// execute the request
-	if err := backend.DoRedirects(&ctx.Request, &ctx.Response, 50); err != nil {
+	start := time.Now()
+	err := backend.DoRedirects(&ctx.Request, &ctx.Response, 50)
+	if done != nil {
+		status := ctx.Response.StatusCode()
+		switch {
+		case err != nil && ctx.Err() != nil:
+			// shutting down isn't the upstream's fault
+			done(breaker.Ignored)
+		case err != nil:
+			done(breaker.Failure)
+		default:
+			done(backend.breaker.Result(status, time.Since(start)))
+		}
+	}
+	if err != nil {
 		ctx.Logger().Printf("error proxying request: %v", err)
+		ctx.Response.Reset()
+		if errors.Is(err, fasthttp.ErrTimeout) {
+			writeError(ctx, st, sx.ErrorGatewayTimeout)
+		} else {
+			writeError(ctx, st, sx.ErrorBadGateway)
+		}
+		return
 	}
+	ctx.Response.Header.Set(sx.RequestIDHeader, id)
 }
 
 // LoadConfig configures the Gateway to use a new configuration.
 // If the gateway was already running, it will start using the new
-// configuration for new requests.
+// configuration for new requests, while in-flight requests complete
+// with the previous one. Only services whose backends changed get a new
+// host client; replaced ones are closed once in-flight requests are done.
 func (g *Gateway) LoadConfig(conf *sx.GatewayConfig) error {
-	newroutes := make([]sx.Route, 0)
-	serviceBackend := make(map[string]*fasthttp.HostClient)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	prev := g.current()
+	st := &state{
+		conf:           conf,
+		routes:         make([]sx.Route, 0),
+		serviceBackend: make(map[string]*hostClient),
+	}
+	st.gen = lifecycle.NewGeneration(st.close)
 	for i := 0; i < len(conf.Services); i++ {
 		svc := conf.Services[i]
-		serviceBackend[svc.Name] = &fasthttp.HostClient{
-			Addr:     strings.Join(svc.Addresses, ","),
-			MaxConns: 1000 * len(svc.Addresses),
+		if c, ok := prev.hostClient(svc); ok {
+			c.Acquire()
+			st.serviceBackend[svc.Name] = c
+		} else {
+			st.serviceBackend[svc.Name] = newHostClient(svc)
 		}
 		svcRoutes, err := svc.CompileRoutes()
 		if err != nil {
-			return errors.Wrapf(err, "in service %q", svc.Name)
+			st.close()
+			return errors.Wrapf(err, "error compiling routes for service %q", svc.Name)
 		}
-		newroutes = append(newroutes, svcRoutes...)
+		st.routes = append(st.routes, svcRoutes...)
+	}
+	g.state.Store(st)
+	if prev != nil {
+		prev.gen.Retire()
+		log.Printf("configuration reloaded: %s", sx.DiffConfig(prev.conf, conf))
 	}
-	// XXX: swap, definitely unsafe
-	g.routes = newroutes
-	g.serviceBackend = serviceBackend
 	return nil
 }
 
+// hostClient returns the host client of svc if it can be reused.
+func (st *state) hostClient(svc *sx.Service) (*hostClient, bool) {
+	if st == nil {
+		return nil, false
+	}
+	c, ok := st.serviceBackend[svc.Name]
+	if !ok || !c.svc.SameBackends(svc) {
+		return nil, false
+	}
+	return c, true
+}
+
+// ListenAndServe is the entrypoint to run the Gateway.
 func (g *Gateway) ListenAndServe(addr string) error {
-	return fasthttp.ListenAndServe(addr, g.ServeFastHTTP)
+	s := &fasthttp.Server{
+		Handler:         g.ServeFastHTTP,
+		CloseOnShutdown: true,
+	}
+	g.mu.Lock()
+	g.s = s
+	g.mu.Unlock()
+	return s.ListenAndServe(addr)
+}
+
+// Shutdown gracefully stops the gateway: it stops accepting connections,
+// then waits for in-flight requests to complete, until ctx is done.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	s := g.s
+	g.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.ShutdownWithContext(ctx)
 }
 
 // // AuthorizeFastHTTP is called for each request to check if it's authorized to pass through.
@@ -1,10 +1,21 @@
 package fasthttp
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/trapped/sx"
+	"github.com/valyala/fasthttp"
 )
 
 func TestGatewayLoadConfig(t *testing.T) {
@@ -23,3 +34,185 @@ func TestGatewayLoadConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGatewayNotLoaded(t *testing.T) {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/mock/")
+	new(Gateway).ServeFastHTTP(ctx)
+	if code, retry := ctx.Response.StatusCode(), string(ctx.Response.Header.Peek("Retry-After")); code != 503 || retry != sx.NotLoadedRetryAfter {
+		t.Errorf("bad response before loading a configuration: %d %q", code, retry)
+	}
+}
+
+func TestGatewayProblemInstance(t *testing.T) {
+	// nothing listens on a closed listener address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+	conf := new(sx.GatewayConfig)
+	err = conf.Read(strings.NewReader(fmt.Sprintf(`
+errors:
+  format: problem
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /*
+`, down)))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	req := new(fasthttp.Request)
+	req.SetRequestURI("http://sx/mock/items")
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init(req, nil, nil)
+	g.ServeFastHTTP(ctx)
+	var p sx.Problem
+	if err := json.Unmarshal(ctx.Response.Body(), &p); err != nil || p.Status != 502 || p.Instance != "/mock/items" {
+		t.Errorf("bad problem for the original path: %v %+v", err, p)
+	}
+}
+
+func TestGatewayConcurrentReload(t *testing.T) {
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello world!"))
+	}))
+	defer mock.Close()
+
+	confs := make([]*sx.GatewayConfig, 2)
+	for i := range confs {
+		confs[i] = new(sx.GatewayConfig)
+		err := confs[i].Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root%d
+        method: GET
+        path: /
+`, mock.Listener.Addr(), i)))
+		if err != nil {
+			t.Fatalf("failed reading configuration: %v", err)
+		}
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(confs[0]); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := g.LoadConfig(confs[i%2]); err != nil {
+				t.Errorf("failed loading configuration: %v", err)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req := new(fasthttp.Request)
+				req.SetRequestURI("http://sx/mock/")
+				req.Header.SetMethod("GET")
+				ctx := new(fasthttp.RequestCtx)
+				ctx.Init(req, nil, nil)
+				g.ServeFastHTTP(ctx)
+				if ctx.Response.StatusCode() != 200 || string(ctx.Response.Body()) != "Hello world!" {
+					t.Errorf("bad response: %v %q", ctx.Response.StatusCode(), ctx.Response.Body())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-reloaded
+}
+
+func TestGatewayShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("Hello world!"))
+	}))
+	defer slow.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: slow
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /
+`, slow.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	go func() {
+		if err := g.ListenAndServe(":7657"); err != nil {
+			t.Errorf("failed to run gateway: %v", err)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", "localhost:7657"); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get("http://localhost:7657/slow/")
+		if err != nil {
+			t.Errorf("failed fetching root: %v", err)
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "Hello world!" {
+			t.Errorf("bad body: %v", string(body))
+		}
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- g.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with requests in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("failed shutting down: %v", err)
+	}
+	<-done
+}
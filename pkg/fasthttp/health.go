@@ -0,0 +1,28 @@
+package fasthttp
+
+import (
+	"context"
+
+	"github.com/trapped/sx/pkg/health"
+	"github.com/valyala/fasthttp"
+)
+
+// Checks reports the health of every critical service's backends.
+func (g *Gateway) Checks(ctx context.Context) (checks []health.Check) {
+	st := g.acquire()
+	if st == nil {
+		return nil
+	}
+	defer st.gen.Release()
+	for _, svc := range st.conf.Services {
+		if !svc.Critical {
+			continue
+		}
+		addrs := make([]string, len(svc.Addresses))
+		for i, addr := range svc.Addresses {
+			addrs[i] = fasthttp.AddMissingPort(addr.Address, false)
+		}
+		checks = append(checks, health.NewCheck("service/"+svc.Name, health.Reachable(ctx, addrs)))
+	}
+	return
+}
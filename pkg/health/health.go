@@ -0,0 +1,122 @@
+// package health implements liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout bounds the time spent running readiness checks.
+const DefaultTimeout = 5 * time.Second
+
+// Check is the outcome of checking a single dependency.
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewCheck returns a Check for dependency name, failed if err is not nil.
+func NewCheck(name string, err error) Check {
+	c := Check{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// CheckFunc checks one or more dependencies.
+type CheckFunc func(ctx context.Context) []Check
+
+// Probe aggregates readiness checks. It's not ready once shutting down.
+type Probe struct {
+	shuttingDown int32
+
+	mu     sync.Mutex
+	checks []CheckFunc
+}
+
+// Add registers a readiness check.
+func (p *Probe) Add(f CheckFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checks = append(p.checks, f)
+}
+
+// Shutdown marks the probe as shutting down, failing readiness.
+func (p *Probe) Shutdown() {
+	atomic.StoreInt32(&p.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether Shutdown was called.
+func (p *Probe) ShuttingDown() bool {
+	return atomic.LoadInt32(&p.shuttingDown) == 1
+}
+
+// Ready runs all checks, reporting whether all of them passed.
+func (p *Probe) Ready(ctx context.Context) (ready bool, checks []Check) {
+	var err error
+	if p.ShuttingDown() {
+		err = errors.New("shutting down")
+	}
+	checks = append(checks, NewCheck("shutdown", err))
+	p.mu.Lock()
+	fs := p.checks
+	p.mu.Unlock()
+	for _, f := range fs {
+		checks = append(checks, f(ctx)...)
+	}
+	ready = true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	return
+}
+
+// Status is the JSON body returned by the readiness endpoint.
+type Status struct {
+	Ready  bool    `json:"ready"`
+	Checks []Check `json:"checks"`
+}
+
+// ServeHTTP reports readiness as JSON, with status 503 if not ready.
+func (p *Probe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), DefaultTimeout)
+	defer cancel()
+	ready, checks := p.Ready(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(Status{ready, checks})
+}
+
+// Live reports the process is alive.
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK\n"))
+}
+
+// Reachable reports whether at least one of the given host:port
+// addresses accepts TCP connections.
+func Reachable(ctx context.Context, addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("no addresses")
+	}
+	var d net.Dialer
+	var err error
+	for _, addr := range addrs {
+		var c net.Conn
+		if c, err = d.DialContext(ctx, "tcp", addr); err == nil {
+			c.Close()
+			return nil
+		}
+	}
+	return errors.Wrap(err, "all backends unreachable")
+}
@@ -0,0 +1,62 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestProbe(t *testing.T) {
+	p := new(Probe)
+	var depErr error
+	p.Add(func(ctx context.Context) []Check {
+		return []Check{NewCheck("dep", depErr)}
+	})
+	serve := func(code int) (s Status) {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		if rec.Code != code {
+			t.Errorf("bad status code: %v", rec.Code)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if s := serve(200); !s.Ready || len(s.Checks) != 2 {
+		t.Errorf("bad status: %+v", s)
+	}
+	depErr = errors.New("down")
+	if s := serve(503); s.Ready || s.Checks[1].OK || s.Checks[1].Error != "down" {
+		t.Errorf("bad status: %+v", s)
+	}
+	depErr = nil
+	p.Shutdown()
+	if s := serve(503); s.Ready || s.Checks[0].Name != "shutdown" || s.Checks[0].OK {
+		t.Errorf("bad status: %+v", s)
+	}
+}
+
+func TestReachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	ctx := context.Background()
+	if err := Reachable(ctx, []string{closed.Addr().String(), l.Addr().String()}); err != nil {
+		t.Errorf("should be reachable: %v", err)
+	}
+	if err := Reachable(ctx, []string{closed.Addr().String()}); err == nil {
+		t.Errorf("should not be reachable")
+	}
+}
@@ -7,27 +7,181 @@ import (
 	"net/url"
 	"strings"
 	"sync/atomic"
+	"time"
+
+	"github.com/trapped/sx"
+	"github.com/trapped/sx/pkg/breaker"
+	"github.com/trapped/sx/pkg/lifecycle"
 )
 
+// backend is shared by all backend groups of a service with the same
+// address and weight, so that it keeps its connections and state across
+// reloads; its idle connections are closed once no group uses it.
 type backend struct {
-	proxy *httputil.ReverseProxy
-	url   *url.URL
+	*lifecycle.Ref
+	service   string
+	proxy     *httputil.ReverseProxy
+	url       *url.URL
+	transport *http.Transport
+	weight    int
+	health    healthState
+	outlier   outlierState
+	// requests in flight, float64 bits of the latency moving average and
+	// unix nanoseconds of its last sample
+	inflight int64
+	ewma     uint64
+	ewmaAt   int64
+	// unix nanoseconds since when the backend is slow starting, if ever
+	warmSince int64
+	// set once a reload removed the backend
+	retired int32
+}
+
+func newBackend(g *Gateway, service string, addr sx.Address) (*backend, error) {
+	burl, err := parseURL(addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	b := &backend{service: service, url: burl, transport: newTransport(), weight: addr.Weight}
+	b.Ref = lifecycle.NewRef(func() {
+		b.transport.CloseIdleConnections()
+		b.deleteHealthyGauge()
+	})
+	b.ownHealthyGauge()
+	b.proxy = httputil.NewSingleHostReverseProxy(burl)
+	b.proxy.Transport = transportFunc(roundTrip)
+	b.proxy.ModifyResponse = func(r *http.Response) error {
+		ctx := r.Request.Context().Value(sxCtxKey).(*sxCtx)
+		ctx.upstreamStatus = r.StatusCode
+		ctx.upstreamLatency = time.Since(ctx.upstreamStart)
+		// retries may have moved the request to another backend
+		ctx.backend.observeLatency(ctx.upstreamLatency)
+		ctx.group.observe(ctx.backend, r.StatusCode, nil)
+		// the gateway already set the request ID of the response
+		r.Header.Del(sx.RequestIDHeader)
+		return g.postResponse(r.Request, r)
+	}
+	b.proxy.ErrorHandler = proxyError
+	return b, nil
+}
+
+// serve proxies r to the backend, tracking it as in flight. Once retired,
+// its idle connections are closed as soon as no request is in flight.
+func (b *backend) serve(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context().Value(sxCtxKey).(*sxCtx)
+	ctx.backend = b
+	b.begin()
+	defer func() { ctx.backend.end() }()
+	b.proxy.ServeHTTP(w, r)
+}
+
+// begin tracks a request as in flight.
+func (b *backend) begin() {
+	atomic.AddInt64(&b.inflight, 1)
+}
+
+// end tracks a request as done.
+func (b *backend) end() {
+	if atomic.AddInt64(&b.inflight, -1) == 0 && atomic.LoadInt32(&b.retired) == 1 {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+// switchBackend moves the request in flight to b, when retried.
+func (ctx *sxCtx) switchBackend(b *backend) {
+	b.begin()
+	ctx.backend.end()
+	ctx.backend = b
+}
+
+// retire stops sending new requests to the backend, closing its idle
+// connections once requests in flight are done.
+func (b *backend) retire() {
+	atomic.StoreInt32(&b.retired, 1)
+	if atomic.LoadInt64(&b.inflight) == 0 {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+func (b *backend) isRetired() bool {
+	return atomic.LoadInt32(&b.retired) == 1
+}
+
+// available reports whether the backend wasn't retired, passes health
+// checks and isn't ejected by outlier detection.
+func (b *backend) available(now time.Time) bool {
+	return !b.isRetired() && b.health.ok() && b.outlier.ok(now)
 }
 
+// backendgroup is shared by all states loading the same service
+// backends; it releases its backends (and stops health checks) once no
+// state uses it.
 type backendgroup struct {
-	backends []backend
-	rr       uint32
+	*lifecycle.Ref
+	svc      *sx.Service
+	backends []*backend
+	balancer balancer
+	sticky   *sticky
+	stop     chan struct{}
+	breaker  *breaker.Breaker
 }
 
-func (bg *backendgroup) next() *backend {
-	if bg.backends == nil {
+// next returns the available backend picked by the load balancer.
+// Backends slow starting are skipped with a probability decreasing as
+// they warm up. If no backend is available, it fails open, balancing
+// across the unhealthy and ejected ones rather than failing every
+// request: health checks and outlier detection may be wrong about all of
+// them at once. Retired backends are never picked, so that removed
+// addresses drain.
+func (bg *backendgroup) next(r *http.Request) *backend {
+	if len(bg.backends) == 0 {
 		return nil
 	}
-	b := &bg.backends[bg.rr%uint32(len(bg.backends))]
-	atomic.AddUint32(&bg.rr, 1)
+	now := time.Now()
+	if b := bg.balancer.pick(r, bg.backends, func(b *backend) bool {
+		return b.available(now) && b.admit(now, bg.svc.SlowStart)
+	}); b != nil {
+		return b
+	}
+	if b := bg.balancer.pick(r, bg.backends, func(b *backend) bool { return b.available(now) }); b != nil {
+		return b
+	}
+	return bg.balancer.pick(r, bg.backends, func(b *backend) bool { return !b.isRetired() })
+}
+
+// backendFor returns the backend r is pinned to by a sticky session, or
+// the next one otherwise, pinning the client to it if sessions are sticky.
+func (bg *backendgroup) backendFor(w http.ResponseWriter, r *http.Request) *backend {
+	if bg.sticky == nil {
+		return bg.next(r)
+	}
+	if b := bg.sticky.backend(r, time.Now()); b != nil {
+		return b
+	}
+	b := bg.next(r)
+	if b != nil {
+		bg.sticky.setCookie(w, r, b)
+	}
 	return b
 }
 
+// backend returns the backend of the group at addr, if any.
+func (bg *backendgroup) backend(addr sx.Address) *backend {
+	if bg == nil {
+		return nil
+	}
+	u, err := parseURL(addr.Address)
+	if err != nil {
+		return nil
+	}
+	for _, b := range bg.backends {
+		if b.url.String() == u.String() && b.weight == addr.Weight {
+			return b
+		}
+	}
+	return nil
+}
+
 func parseURL(u string) (*url.URL, error) {
 	if strings.IndexByte(u, ':') >= 0 && !strings.Contains(u, "://") {
 		host, port, err := net.SplitHostPort(u)
@@ -39,21 +193,54 @@ func parseURL(u string) (*url.URL, error) {
 	return url.Parse(u)
 }
 
-func newBackendGroup(g *Gateway, upstreams []string) (bg *backendgroup, err error) {
+// newBackendGroup builds the backends of svc, reusing those of prev (the
+// group svc had before a reload, if any) with the same address and
+// weight. Backends whose address wasn't in prev slow start.
+func newBackendGroup(g *Gateway, svc *sx.Service, prev *backendgroup) (bg *backendgroup, err error) {
+	upstreams := svc.Addresses
 	bg = &backendgroup{
-		backends: make([]backend, len(upstreams)),
+		svc:      svc,
+		backends: make([]*backend, 0, len(upstreams)),
+		stop:     make(chan struct{}),
 	}
-	for i := 0; i < len(upstreams); i++ {
-		burl, err := parseURL(upstreams[i])
+	bg.Ref = lifecycle.NewRef(func() {
+		close(bg.stop)
+		for _, b := range bg.backends {
+			b.Release()
+		}
+		if bg.breaker != nil {
+			bg.breaker.Close()
+		}
+	})
+	for _, addr := range upstreams {
+		if b := prev.backend(addr); b != nil {
+			b.Acquire()
+			if svc.HealthCheck == nil {
+				// nothing would mark it healthy again
+				b.health.reset()
+			}
+			bg.backends = append(bg.backends, b)
+			continue
+		}
+		b, err := newBackend(g, svc.Name, addr)
 		if err != nil {
+			bg.Release()
 			return nil, err
 		}
-		proxy := httputil.NewSingleHostReverseProxy(burl)
-		proxy.Transport = newTransport()
-		proxy.ModifyResponse = func(r *http.Response) error {
-			return g.postResponse(r.Request, r)
+		if svc.SlowStart > 0 && prev != nil && !prev.has(b.url) {
+			b.recovered(time.Now())
 		}
-		bg.backends[i] = backend{proxy, burl}
+		bg.backends = append(bg.backends, b)
+	}
+	bg.balancer = newBalancer(svc, bg.backends)
+	if svc.Sticky != nil {
+		bg.sticky = newSticky(svc, bg.backends)
+	}
+	if svc.CircuitBreaker != nil {
+		bg.breaker = breaker.New(svc.Name, *svc.CircuitBreaker)
+	}
+	if svc.HealthCheck != nil {
+		go bg.healthCheck(svc.HealthCheck)
 	}
 	return
 }
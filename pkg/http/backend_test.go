@@ -1,8 +1,16 @@
 package http
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/trapped/sx"
 )
 
 func TestParseURL(t *testing.T) {
@@ -25,16 +33,154 @@ func TestBackendGroupNext(t *testing.T) {
 		return u
 	}
 	bg := &backendgroup{
-		backends: []backend{
+		svc:      new(sx.Service),
+		balancer: new(roundRobin),
+		backends: []*backend{
 			{url: mustparse("http://google.com")},
 			{url: mustparse("localhost:8080")},
 		},
 	}
-	next_1 := bg.next().url.Host == "google.com"
-	next_2 := bg.next().url.Host == "localhost:8080"
-	next_3 := bg.next().url.Host == "google.com"
-	next_4 := bg.next().url.Host == "localhost:8080"
+	next_1 := bg.next(nil).url.Host == "google.com"
+	next_2 := bg.next(nil).url.Host == "localhost:8080"
+	next_3 := bg.next(nil).url.Host == "google.com"
+	next_4 := bg.next(nil).url.Host == "localhost:8080"
 	if !(next_1 && next_2 && next_3 && next_4) {
 		t.Error("bad backendgroup round robin rotation")
 	}
 }
+
+func TestBackendGroupNextFailOpen(t *testing.T) {
+	bg := &backendgroup{
+		svc:      new(sx.Service),
+		balancer: new(roundRobin),
+		backends: []*backend{{}, {}},
+	}
+	// unhealthy backends are still used if no backend is available...
+	bg.backends[0].health.down = 1
+	bg.backends[1].health.down = 1
+	bg.backends[1].retired = 1
+	for i := 0; i < 4; i++ {
+		if b := bg.next(nil); b != bg.backends[0] {
+			t.Fatalf("expected the unhealthy backend, got %p", b)
+		}
+	}
+	// ...but never retired ones
+	bg.backends[0].retired = 1
+	if b := bg.next(nil); b != nil {
+		t.Errorf("retired backend picked")
+	}
+}
+
+func TestReloadPreservesBackendGroups(t *testing.T) {
+	read := func(path string) *sx.GatewayConfig {
+		conf := new(sx.GatewayConfig)
+		err := conf.Read(strings.NewReader(`
+services:
+  - name: a
+    addresses: [localhost:8080, localhost:8081]
+    routes:
+      - name: root
+        path: ` + path + `
+`))
+		if err != nil {
+			t.Fatalf("failed reading configuration: %v", err)
+		}
+		return conf
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(read("/")); err != nil {
+		t.Fatal(err)
+	}
+	bg := g.current().serviceBackends["a"]
+	bg.next(nil)
+	if err := g.LoadConfig(read("/*")); err != nil {
+		t.Fatal(err)
+	}
+	if g.current().serviceBackends["a"] != bg {
+		t.Fatalf("backend group rebuilt on route change")
+	}
+	if b := bg.next(nil); b.url.Host != "localhost:8081" {
+		t.Errorf("round robin state not preserved: %v", b.url.Host)
+	}
+}
+
+func TestReloadDrainsRemovedBackends(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	removed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("removed"))
+	}))
+	defer removed.Close()
+	kept := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("kept"))
+	}))
+	defer kept.Close()
+
+	read := func(addrs ...string) *sx.GatewayConfig {
+		conf := new(sx.GatewayConfig)
+		err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /*
+`, strings.Join(addrs, `", "`))))
+		if err != nil {
+			t.Fatalf("failed reading configuration: %v", err)
+		}
+		return conf
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(read(removed.Listener.Addr().String(), kept.Listener.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+	old := g.current().serviceBackends["mock"].backends
+	get := func() string {
+		res, err := http.Get(gw.URL + "/mock/")
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	// the first request goes to the backend about to be removed
+	done := make(chan string)
+	go func() { done <- get() }()
+	<-started
+	if err := g.LoadConfig(read(kept.Listener.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+	if g.current().serviceBackends["mock"].backends[0] != old[1] {
+		t.Errorf("unchanged backend not reused")
+	}
+	for i := 0; i < 4; i++ {
+		if body := get(); body != "kept" {
+			t.Errorf("request sent to removed backend")
+		}
+	}
+	if old[0].Closed() {
+		t.Errorf("removed backend closed with a request in flight")
+	}
+	close(release)
+	if body := <-done; body != "removed" {
+		t.Errorf("in-flight request to removed backend failed: %q", body)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !old[0].Closed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !old[0].Closed() {
+		t.Errorf("removed backend not closed after draining")
+	}
+	if old[1].Closed() {
+		t.Errorf("kept backend closed")
+	}
+}
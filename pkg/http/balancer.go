@@ -0,0 +1,219 @@
+package http
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+// balancer picks a backend for r among those accepted by ok, returning
+// nil if there are none.
+type balancer interface {
+	pick(r *http.Request, backends []*backend, ok func(*backend) bool) *backend
+}
+
+func newBalancer(svc *sx.Service, backends []*backend) balancer {
+	switch svc.LoadBalancer {
+	case sx.LoadBalancerWeightedRoundRobin:
+		return new(weightedRoundRobin)
+	case sx.LoadBalancerLeastConnections:
+		return &leastLoaded{load: (*backend).connections}
+	case sx.LoadBalancerRandomTwoChoices:
+		return new(randomTwoChoices)
+	case sx.LoadBalancerEWMALatency:
+		return new(ewmaLatency)
+	case sx.LoadBalancerHash:
+		return newHashRing(svc.Hash.Keys, backends)
+	}
+	return new(roundRobin)
+}
+
+// roundRobin ignores weights.
+type roundRobin struct {
+	rr uint32
+}
+
+func (b *roundRobin) pick(r *http.Request, backends []*backend, ok func(*backend) bool) *backend {
+	n := atomic.AddUint32(&b.rr, 1) - 1
+	l := uint32(len(backends))
+	for i := uint32(0); i < l; i++ {
+		if be := backends[(n+i)%l]; ok(be) {
+			return be
+		}
+	}
+	return nil
+}
+
+// weightedRoundRobin implements nginx's smooth weighted round-robin,
+// which interleaves picks rather than sending bursts to heavier backends.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*backend]int
+}
+
+func (b *weightedRoundRobin) pick(r *http.Request, backends []*backend, ok func(*backend) bool) *backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil {
+		b.current = make(map[*backend]int, len(backends))
+	}
+	var best *backend
+	total := 0
+	for _, be := range backends {
+		if !ok(be) {
+			continue
+		}
+		b.current[be] += be.weight
+		total += be.weight
+		if best == nil || b.current[be] > b.current[best] {
+			best = be
+		}
+	}
+	if best != nil {
+		b.current[best] -= total
+	}
+	return best
+}
+
+// leastLoaded picks the backend with the lowest load relative to its
+// weight, starting from a rotating offset so that ties are spread.
+type leastLoaded struct {
+	rr   uint32
+	load func(*backend) float64
+}
+
+func (b *leastLoaded) pick(r *http.Request, backends []*backend, ok func(*backend) bool) *backend {
+	return b.pickBy(backends, ok, b.load)
+}
+
+func (b *leastLoaded) pickBy(backends []*backend, ok func(*backend) bool, load func(*backend) float64) *backend {
+	n := atomic.AddUint32(&b.rr, 1) - 1
+	l := uint32(len(backends))
+	var best *backend
+	bestLoad := math.Inf(1)
+	for i := uint32(0); i < l; i++ {
+		be := backends[(n+i)%l]
+		if !ok(be) {
+			continue
+		}
+		if load := load(be) / float64(be.weight); best == nil || load < bestLoad {
+			best, bestLoad = be, load
+		}
+	}
+	return best
+}
+
+// randomTwoChoices picks two random backends and keeps the one with the
+// fewest connections relative to its weight.
+type randomTwoChoices struct{}
+
+func (randomTwoChoices) pick(r *http.Request, backends []*backend, ok func(*backend) bool) *backend {
+	l := len(backends)
+	i, j := rand.Intn(l), rand.Intn(l)
+	var a, b *backend
+	// probe from the random positions for the first accepted backends
+	for k := 0; k < l && (a == nil || b == nil); k++ {
+		if a == nil && ok(backends[(i+k)%l]) {
+			a = backends[(i+k)%l]
+		}
+		if b == nil && ok(backends[(j+k)%l]) {
+			b = backends[(j+k)%l]
+		}
+	}
+	if a == nil || b == nil {
+		return nil
+	}
+	if b.connections()/float64(b.weight) < a.connections()/float64(a.weight) {
+		return b
+	}
+	return a
+}
+
+// ewmaLatency picks the backend with the lowest latencyCost relative to
+// its weight.
+type ewmaLatency struct {
+	leastLoaded
+}
+
+func (b *ewmaLatency) pick(r *http.Request, backends []*backend, ok func(*backend) bool) *backend {
+	var sum float64
+	n := 0
+	for _, be := range backends {
+		if ewma := be.latency(); ewma > 0 {
+			sum, n = sum+ewma, n+1
+		}
+	}
+	now := time.Now()
+	return b.pickBy(backends, ok, func(be *backend) float64 {
+		return be.latencyCost(sum, n, now)
+	})
+}
+
+// ewmaDecay is the weight of the previous average when recording a
+// latency sample.
+const ewmaDecay = 0.8
+
+// ewmaRecovery is the time constant with which latency averages without
+// new samples move back towards the average of the other backends, so
+// that backends penalized for failures are eventually tried again.
+const ewmaRecovery = 10 * time.Second
+
+// connections returns the number of requests in flight to the backend.
+func (b *backend) connections() float64 {
+	return float64(atomic.LoadInt64(&b.inflight))
+}
+
+// latency returns the backend's average latency, 0 if it has no samples.
+func (b *backend) latency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&b.ewma))
+}
+
+// latencyCost estimates the time a new request would take: the average
+// latency times the requests already queued. sum and n are the sum and
+// count of the latency averages of the group: backends without samples
+// are assumed to be as fast as the group on average, and stale averages
+// move back towards the average of the other backends.
+func (b *backend) latencyCost(sum float64, n int, now time.Time) float64 {
+	ewma := b.latency()
+	switch {
+	case ewma == 0 && n > 0:
+		ewma = sum / float64(n)
+	case ewma > 0 && n > 1:
+		others := (sum - ewma) / float64(n-1)
+		age := now.Sub(time.Unix(0, atomic.LoadInt64(&b.ewmaAt)))
+		ewma = others + (ewma-others)*math.Exp(-float64(age)/float64(ewmaRecovery))
+	}
+	return ewma * (b.connections() + 1)
+}
+
+// observeFailure records a failed request as a latency sample of at
+// least its timeout, so that failing backends don't look fast.
+func (b *backend) observeFailure(elapsed, timeout time.Duration) {
+	if elapsed < timeout {
+		elapsed = timeout
+	}
+	b.observeLatency(elapsed)
+}
+
+// observeLatency updates the backend's exponentially weighted moving
+// average of response latencies.
+func (b *backend) observeLatency(d time.Duration) {
+	atomic.StoreInt64(&b.ewmaAt, time.Now().UnixNano())
+	for {
+		old := atomic.LoadUint64(&b.ewma)
+		ewma := math.Float64frombits(old)
+		if ewma == 0 {
+			ewma = float64(d)
+		} else {
+			ewma = ewmaDecay*ewma + (1-ewmaDecay)*float64(d)
+		}
+		if atomic.CompareAndSwapUint64(&b.ewma, old, math.Float64bits(ewma)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func testBackends(weights ...int) []*backend {
+	backends := make([]*backend, len(weights))
+	for i, w := range weights {
+		backends[i] = &backend{weight: w}
+	}
+	return backends
+}
+
+func all(*backend) bool { return true }
+
+func TestWeightedRoundRobin(t *testing.T) {
+	backends := testBackends(5, 1, 1)
+	b := newBalancer(&sx.Service{LoadBalancer: sx.LoadBalancerWeightedRoundRobin}, backends)
+	expected := []int{0, 0, 1, 0, 2, 0, 0}
+	for round := 0; round < 2; round++ {
+		for i, e := range expected {
+			if be := b.pick(nil, backends, all); be != backends[e] {
+				t.Fatalf("round %d pick %d: expected backend %d", round, i, e)
+			}
+		}
+	}
+	// unavailable backends are skipped
+	if be := b.pick(nil, backends, func(be *backend) bool { return be != backends[0] }); be == backends[0] || be == nil {
+		t.Errorf("bad pick with unavailable backend")
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	backends := testBackends(1, 2, 1)
+	backends[0].inflight = 2
+	backends[1].inflight = 3 // 1.5 per weight unit
+	backends[2].inflight = 1
+	b := newBalancer(&sx.Service{LoadBalancer: sx.LoadBalancerLeastConnections}, backends)
+	if be := b.pick(nil, backends, all); be != backends[2] {
+		t.Errorf("expected the least loaded backend")
+	}
+	backends[2].inflight = 4
+	if be := b.pick(nil, backends, all); be != backends[1] {
+		t.Errorf("expected the least loaded backend relative to its weight")
+	}
+	if be := b.pick(nil, backends, func(be *backend) bool { return be == backends[0] }); be != backends[0] {
+		t.Errorf("expected the only available backend")
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	backends := testBackends(1, 1)
+	backends[0].inflight = 100
+	b := newBalancer(&sx.Service{LoadBalancer: sx.LoadBalancerRandomTwoChoices}, backends)
+	idle := 0
+	for i := 0; i < 1000; i++ {
+		if b.pick(nil, backends, all) == backends[1] {
+			idle++
+		}
+	}
+	// only loses when both choices are the loaded backend
+	if idle < 650 {
+		t.Errorf("idle backend picked %d times out of 1000", idle)
+	}
+	if be := b.pick(nil, backends, func(*backend) bool { return false }); be != nil {
+		t.Errorf("expected no backend")
+	}
+}
+
+func TestEWMALatency(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	backends[0].observeLatency(100 * time.Millisecond)
+	backends[1].observeLatency(10 * time.Millisecond)
+	b := newBalancer(&sx.Service{LoadBalancer: sx.LoadBalancerEWMALatency}, backends)
+	// backends without samples cost the average, 55ms
+	if be := b.pick(nil, backends, all); be != backends[1] {
+		t.Errorf("expected the fastest backend")
+	}
+	backends[1].inflight = 10
+	if be := b.pick(nil, backends, all); be != backends[2] {
+		t.Errorf("expected a busy backend to cost more than one without samples")
+	}
+	backends[2].observeLatency(50 * time.Millisecond)
+	if be := b.pick(nil, backends, all); be != backends[2] {
+		t.Errorf("expected a busy backend to cost more")
+	}
+	// the average moves towards new samples
+	backends[0].observeLatency(0)
+	if l := backends[0].latency(); l != float64(80*time.Millisecond) {
+		t.Errorf("bad moving average: %v", time.Duration(l))
+	}
+}
+
+func TestEWMALatencyFailures(t *testing.T) {
+	backends := testBackends(1, 1)
+	backends[0].observeLatency(10 * time.Millisecond)
+	// failing fast still costs the timeout
+	backends[1].observeFailure(time.Millisecond, time.Minute)
+	b := newBalancer(&sx.Service{LoadBalancer: sx.LoadBalancerEWMALatency}, backends)
+	for i := 0; i < 4; i++ {
+		if be := b.pick(nil, backends, all); be != backends[0] {
+			t.Fatalf("failing backend picked")
+		}
+	}
+	// the penalty fades once the failing backend is stale
+	sum, n := backends[0].latency()+backends[1].latency(), 2
+	stale := time.Now().Add(20 * ewmaRecovery)
+	if c := backends[1].latencyCost(sum, n, stale); c > float64(11*time.Millisecond) {
+		t.Errorf("stale penalty still applied: %v", time.Duration(c))
+	}
+}
+
+func TestGatewayEWMALatencyRefused(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	// nothing listens on a closed listener address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	conf := new(sx.GatewayConfig)
+	err = conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    loadbalancer: ewma_latency
+    addresses: ["%s", "%s"]
+    routes:
+      - name: root
+        path: /*
+`, down, upstream.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	statuses := make(map[int]int)
+	for i := 0; i < 50; i++ {
+		res, err := http.Get(gw.URL + "/mock/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		statuses[res.StatusCode]++
+	}
+	// the refusing backend is only tried until it has a sample
+	if statuses[200] < 48 {
+		t.Errorf("requests sent to the refusing backend: %v", statuses)
+	}
+}
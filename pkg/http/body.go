@@ -0,0 +1,32 @@
+package http
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// errBodyTooLarge is returned by limitedBody once its limit is exceeded.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody fails reads with errBodyTooLarge once more than left bytes
+// were read.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package http
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+// grpcTimeoutUnits are the grpc-timeout units, from the shortest.
+var grpcTimeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// maxDuration is the longest time.Duration.
+const maxDuration = time.Duration(math.MaxInt64)
+
+// parseGRPCTimeout parses a grpc-timeout header value: at most 8 digits
+// followed by a unit. Timeouts too long for a time.Duration (about 292
+// years) are ignored like missing ones.
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	for i := 0; i < len(v)-1; i++ {
+		if v[i] < '0' || v[i] > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	for _, u := range grpcTimeoutUnits {
+		if u.unit == v[len(v)-1] {
+			if time.Duration(n) > maxDuration/u.d {
+				return 0, false
+			}
+			return time.Duration(n) * u.d, true
+		}
+	}
+	return 0, false
+}
+
+// formatGRPCTimeout formats d as a grpc-timeout header value, in the
+// shortest unit it fits in, rounding up.
+func formatGRPCTimeout(d time.Duration) string {
+	for _, u := range grpcTimeoutUnits {
+		if n := (d + u.d - 1) / u.d; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+// isGRPC reports whether r is a gRPC request.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// clientDeadline returns the deadline set by the client of r with the
+// grpc-timeout or deadline header, the earliest if both are set. Values
+// too long for a time.Duration are ignored.
+func clientDeadline(conf *sx.GatewayConfig, r *http.Request, now time.Time) (deadline time.Time, ok bool) {
+	if d, valid := parseGRPCTimeout(r.Header.Get("grpc-timeout")); valid {
+		deadline, ok = now.Add(d), true
+	}
+	ms, err := strconv.ParseInt(r.Header.Get(conf.Deadline.Header), 10, 64)
+	if err == nil && ms >= 0 && time.Duration(ms) <= maxDuration/time.Millisecond {
+		if d := now.Add(time.Duration(ms) * time.Millisecond); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	return
+}
+
+// requestDeadline returns the deadline of the upstream request for r:
+// the earliest of the route total timeout and the client deadline, if
+// any. fromClient reports whether it's the client deadline.
+func requestDeadline(conf *sx.GatewayConfig, rt *sx.Route, r *http.Request, now time.Time) (deadline time.Time, fromClient, ok bool) {
+	if t := rt.RouteGroup.Timeout; t != nil && t.Total > 0 {
+		deadline, ok = now.Add(t.Total), true
+	}
+	if d, client := clientDeadline(conf, r, now); client && (!ok || d.Before(deadline)) {
+		deadline, fromClient, ok = d, true, true
+	}
+	return
+}
+
+// forwardDeadline returns a copy of req telling the upstream the time
+// left before deadline, with the deadline header and, for gRPC requests,
+// grpc-timeout.
+func forwardDeadline(req *http.Request, header string, deadline time.Time) *http.Request {
+	left := time.Until(deadline)
+	if left <= 0 {
+		return req
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(header, strconv.FormatInt(int64(left/time.Millisecond), 10))
+	if isGRPC(r) || r.Header.Get("grpc-timeout") != "" {
+		r.Header.Set("grpc-timeout", formatGRPCTimeout(left))
+	}
+	return r
+}
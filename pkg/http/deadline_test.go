@@ -0,0 +1,143 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestGRPCTimeout(t *testing.T) {
+	for v, expected := range map[string]time.Duration{
+		"100m":      100 * time.Millisecond,
+		"3S":        3 * time.Second,
+		"1H":        time.Hour,
+		"99999999n": 99999999 * time.Nanosecond,
+	} {
+		if d, ok := parseGRPCTimeout(v); !ok || d != expected {
+			t.Errorf("%s: expected %s, got %s", v, expected, d)
+		}
+	}
+	for _, v := range []string{"", "m", "100", "100x", "-1m", "+1m", " 1m", "123456789m", "99999999H"} {
+		if _, ok := parseGRPCTimeout(v); ok {
+			t.Errorf("%q: invalid value parsed", v)
+		}
+	}
+	for d, expected := range map[time.Duration]string{
+		1500 * time.Nanosecond: "1500n",
+		2 * time.Second:        "2000000u",
+		time.Minute:            "60000000u",
+		time.Hour:              "3600000m",
+	} {
+		if v := formatGRPCTimeout(d); v != expected {
+			t.Errorf("%s: expected %s, got %s", d, expected, v)
+		}
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	conf := &sx.GatewayConfig{Deadline: sx.Deadline{Header: sx.DefaultDeadlineHeader}}
+	rt := &sx.Route{RouteGroup: &sx.RouteGroup{Timeout: &sx.Timeout{Total: time.Second}}}
+	now := time.Now()
+	for _, c := range []struct {
+		headers    map[string]string
+		expected   time.Duration
+		fromClient bool
+	}{
+		{nil, time.Second, false},
+		{map[string]string{"X-Request-Deadline": "2000"}, time.Second, false},
+		{map[string]string{"X-Request-Deadline": "500"}, 500 * time.Millisecond, true},
+		{map[string]string{"X-Request-Deadline": "500", "grpc-timeout": "200m"}, 200 * time.Millisecond, true},
+		{map[string]string{"X-Request-Deadline": "soon"}, time.Second, false},
+		// too long for a time.Duration
+		{map[string]string{"X-Request-Deadline": "9223372036854775"}, time.Second, false},
+		{map[string]string{"X-Request-Deadline": "9223372036854", "grpc-timeout": "99999999H"}, time.Second, false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		d, fromClient, ok := requestDeadline(conf, rt, r, now)
+		if !ok || d.Sub(now) != c.expected || fromClient != c.fromClient {
+			t.Errorf("%v: bad deadline: %s %v %v", c.headers, d.Sub(now), fromClient, ok)
+		}
+	}
+	rt.RouteGroup.Timeout = nil
+	if _, _, ok := requestDeadline(conf, rt, httptest.NewRequest("GET", "/", nil), now); ok {
+		t.Errorf("deadline set without timeout nor client deadline")
+	}
+}
+
+func TestGatewayDeadline(t *testing.T) {
+	var hits int32
+	forwarded := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		forwarded <- r.Header.Get("X-Deadline") + " " + r.Header.Get("grpc-timeout")
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+deadline:
+  header: X-Deadline
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /*
+`, upstream.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	get := func(deadline string) int {
+		req, _ := http.NewRequest("GET", gw.URL+"/mock/", nil)
+		req.Header.Set("X-Deadline", deadline)
+		req.Header.Set("Content-Type", "application/grpc")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	start := time.Now()
+	if status := get("100"); status != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", status)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("upstream request not cancelled at the deadline: %s", d)
+	}
+	var ms int
+	var grpcTimeout string
+	fmt.Sscanf(<-forwarded, "%d %s", &ms, &grpcTimeout)
+	if ms <= 0 || ms > 100 {
+		t.Errorf("bad forwarded deadline: %d", ms)
+	}
+	if d, ok := parseGRPCTimeout(grpcTimeout); !ok || d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("bad forwarded grpc-timeout: %q", grpcTimeout)
+	}
+	// expired deadlines aren't forwarded at all
+	if status := get("0"); status != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", status)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expired request sent upstream")
+	}
+}
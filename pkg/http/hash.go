@@ -0,0 +1,83 @@
+package http
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/trapped/sx"
+)
+
+// hashRingReplicas is the number of points each unit of weight places on
+// the hash ring; more points spread keys more evenly.
+const hashRingReplicas = 160
+
+// hashRing is a consistent hash ring: backends are placed on the ring at
+// points derived from their URL, and a key belongs to the first backend
+// found clockwise from its hash. Adding or removing a backend only moves
+// the keys between its points and the previous ones.
+type hashRing struct {
+	keys     []sx.CacheKey
+	points   []uint64
+	backends []*backend
+	// fallback for requests without keys
+	rr roundRobin
+}
+
+func newHashRing(keys []sx.CacheKey, backends []*backend) *hashRing {
+	h := &hashRing{keys: keys}
+	type point struct {
+		hash uint64
+		b    *backend
+	}
+	var points []point
+	for _, b := range backends {
+		for i := 0; i < hashRingReplicas*b.weight; i++ {
+			points = append(points, point{hashKey(b.url.String() + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	h.points = make([]uint64, len(points))
+	h.backends = make([]*backend, len(points))
+	for i, p := range points {
+		h.points[i], h.backends[i] = p.hash, p.b
+	}
+	return h
+}
+
+func (h *hashRing) pick(r *http.Request, backends []*backend, ok func(*backend) bool) *backend {
+	ks := sx.CacheKeySet(h.keys).Extract(&httpCacheKeyExtractor{r})
+	if strings.Join(ks, "") == "" {
+		return h.rr.pick(r, backends, ok)
+	}
+	return h.get(hashKey(strings.Join(ks, "\x00")), ok)
+}
+
+// get returns the first backend accepted by ok clockwise from hash.
+func (h *hashRing) get(hash uint64, ok func(*backend) bool) *backend {
+	l := len(h.points)
+	start := sort.Search(l, func(i int) bool { return h.points[i] >= hash })
+	for i := 0; i < l; i++ {
+		if b := h.backends[(start+i)%l]; ok(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// hashKey hashes s with FNV-1a, mixing the result so that similar strings
+// (like a backend's point names) spread across the ring.
+func hashKey(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := f.Sum64()
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/trapped/sx"
+)
+
+func hashBackends(n int) []*backend {
+	backends := make([]*backend, n)
+	for i := range backends {
+		backends[i] = &backend{url: &url.URL{Scheme: "http", Host: fmt.Sprintf("10.0.0.%d:8080", i)}, weight: 1}
+	}
+	return backends
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	backends := hashBackends(4)
+	h := newHashRing(nil, backends)
+	counts := map[*backend]int{}
+	for i := 0; i < 10000; i++ {
+		counts[h.get(hashKey(strconv.Itoa(i)), all)]++
+	}
+	for i, b := range backends {
+		if counts[b] < 1500 || counts[b] > 3500 {
+			t.Errorf("backend %d got %d keys out of 10000", i, counts[b])
+		}
+	}
+}
+
+func TestHashRingRemap(t *testing.T) {
+	before := newHashRing(nil, hashBackends(4))
+	backends := hashBackends(5)
+	after := newHashRing(nil, backends)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		k := hashKey(strconv.Itoa(i))
+		b, a := before.get(k, all), after.get(k, all)
+		if b.url.Host != a.url.Host {
+			moved++
+			if a != backends[4] {
+				t.Fatalf("key moved between existing backends")
+			}
+		}
+	}
+	// ideally a fifth of the keys
+	if moved > 3000 {
+		t.Errorf("%d keys out of 10000 remapped", moved)
+	}
+
+	// keys of an unavailable backend move, the others don't
+	down := backends[0]
+	for i := 0; i < 1000; i++ {
+		k := hashKey(strconv.Itoa(i))
+		b := after.get(k, func(b *backend) bool { return b != down })
+		if a := after.get(k, all); a != down && a != b {
+			t.Fatalf("key moved away from an available backend")
+		}
+	}
+}
+
+func TestHashRingPick(t *testing.T) {
+	backends := hashBackends(3)
+	cookie := "session"
+	b := newBalancer(&sx.Service{
+		LoadBalancer: sx.LoadBalancerHash,
+		Hash:         &sx.Hash{Keys: []sx.CacheKey{{Cookie: &cookie}}},
+	}, backends)
+	request := func(session string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		if session != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		return r
+	}
+	for i := 0; i < 10; i++ {
+		s := strconv.Itoa(i)
+		if b.pick(request(s), backends, all) != b.pick(request(s), backends, all) {
+			t.Errorf("same key picked different backends")
+		}
+	}
+	// requests without keys are balanced round-robin
+	seen := map[*backend]bool{}
+	for i := 0; i < 3; i++ {
+		seen[b.pick(request(""), backends, all)] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("requests without keys not balanced")
+	}
+}
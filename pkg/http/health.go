@@ -0,0 +1,62 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx/pkg/health"
+	"github.com/trapped/sx/pkg/redis"
+)
+
+// Checks reports the health of the gateway's critical dependencies: Redis
+// if marked as critical, and every critical service's backends.
+func (g *Gateway) Checks(ctx context.Context) (checks []health.Check) {
+	st := g.acquire()
+	if st == nil {
+		return nil
+	}
+	defer st.gen.Release()
+	if c, ok := st.store.Store.(*redis.Client); ok && st.conf.Redis.Critical {
+		checks = append(checks, health.NewCheck("redis", c.Ping(ctx)))
+	}
+	for _, svc := range st.conf.Services {
+		if !svc.Critical {
+			continue
+		}
+		bg := st.serviceBackends[svc.Name]
+		checks = append(checks, health.NewCheck("service/"+svc.Name, bg.reachable(ctx)))
+	}
+	return
+}
+
+// reachable reports whether at least one backend is healthy, or accepts
+// connections if the service has no health checks.
+func (bg *backendgroup) reachable(ctx context.Context) error {
+	if bg.svc.HealthCheck != nil {
+		for _, b := range bg.backends {
+			if b.health.ok() {
+				return nil
+			}
+		}
+		return errors.New("all backends unhealthy")
+	}
+	addrs := make([]string, len(bg.backends))
+	for i, b := range bg.backends {
+		addrs[i] = hostPort(b.url)
+	}
+	return health.Reachable(ctx, addrs)
+}
+
+// hostPort returns the address to dial for u, with the scheme's default
+// port if it has none.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" && u.Scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
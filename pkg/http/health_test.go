@@ -0,0 +1,83 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/trapped/sx"
+)
+
+func TestGatewayChecks(t *testing.T) {
+	mock := httptest.NewServer(new(mockServer))
+	defer mock.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	g := new(Gateway)
+	if checks := g.Checks(context.Background()); len(checks) != 0 {
+		t.Errorf("expected no checks before loading: %+v", checks)
+	}
+	conf := new(sx.GatewayConfig)
+	err = conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: up
+    critical: true
+    addresses: ["%s", "%s"]
+    routes:
+      - name: root
+        path: /
+  - name: down
+    critical: true
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /
+  - name: ignored
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /
+`, dead, mock.Listener.Addr(), dead, dead)))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	checks := g.Checks(context.Background())
+	if len(checks) != 2 {
+		t.Fatalf("expected 2 checks, got %+v", checks)
+	}
+	if c := checks[0]; c.Name != "service/up" || !c.OK {
+		t.Errorf("service up should be healthy: %+v", c)
+	}
+	if c := checks[1]; c.Name != "service/down" || c.OK || c.Error == "" {
+		t.Errorf("service down should be unhealthy: %+v", c)
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"http://localhost", "localhost:80"},
+		{"https://localhost", "localhost:443"},
+		{"localhost:8080", "localhost:8080"},
+		{"http://[::1]/", "[::1]:80"},
+	}
+	for _, c := range cases {
+		u, err := parseURL(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := hostPort(u); out != c.out {
+			t.Errorf("hostPort(%q) = %q, expected %q", c.in, out, c.out)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package http
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+)
+
+// healthState tracks a backend's health as determined by active health
+// checks. Backends start healthy.
+type healthState struct {
+	down int32
+	// the groups sharing a backend may all be checking it during reloads
+	mu                  sync.Mutex
+	successes, failures int
+}
+
+func (h *healthState) ok() bool {
+	return atomic.LoadInt32(&h.down) == 0
+}
+
+// reset marks the backend healthy.
+func (h *healthState) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.successes, h.failures = 0, 0
+	atomic.StoreInt32(&h.down, 0)
+}
+
+// update records a health check result, returning whether the backend
+// changed state.
+func (h *healthState) update(hc *sx.HealthCheck, err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.successes, h.failures = h.successes+1, 0
+		if !h.ok() && h.successes >= hc.HealthyThreshold {
+			atomic.StoreInt32(&h.down, 0)
+			return true
+		}
+		return false
+	}
+	h.successes, h.failures = 0, h.failures+1
+	if h.ok() && h.failures >= hc.UnhealthyThreshold {
+		atomic.StoreInt32(&h.down, 1)
+		return true
+	}
+	return false
+}
+
+// healthyGauges maps the labels of sx_backend_healthy series to the
+// backend reporting them: the latest one built for the address, since a
+// reload can rebuild a backend (with a new weight, for example) while the
+// previous one drains.
+var healthyGauges = struct {
+	sync.Mutex
+	owners map[[2]string]*backend
+}{owners: make(map[[2]string]*backend)}
+
+func (b *backend) gaugeLabels() [2]string {
+	return [2]string{b.service, b.url.String()}
+}
+
+// ownHealthyGauge makes b report its address health.
+func (b *backend) ownHealthyGauge() {
+	healthyGauges.Lock()
+	defer healthyGauges.Unlock()
+	healthyGauges.owners[b.gaugeLabels()] = b
+}
+
+// setHealthyGauge reports the health of b, unless a newer backend for the
+// same address does.
+func (b *backend) setHealthyGauge(v float64) {
+	healthyGauges.Lock()
+	defer healthyGauges.Unlock()
+	if healthyGauges.owners[b.gaugeLabels()] == b {
+		metricBackendHealthy.WithLabelValues(b.service, b.url.String()).Set(v)
+	}
+}
+
+// deleteHealthyGauge deletes the health series of b, unless a newer
+// backend for the same address reports it.
+func (b *backend) deleteHealthyGauge() {
+	healthyGauges.Lock()
+	defer healthyGauges.Unlock()
+	labels := b.gaugeLabels()
+	if healthyGauges.owners[labels] == b {
+		delete(healthyGauges.owners, labels)
+		metricBackendHealthy.DeleteLabelValues(b.service, b.url.String())
+	}
+}
+
+// healthCheck probes every backend each hc.Interval until the group is
+// closed.
+func (bg *backendgroup) healthCheck(hc *sx.HealthCheck) {
+	ref, err := url.Parse(hc.Path)
+	if err != nil {
+		log.Printf("error parsing health check path for service %q: %v", bg.svc.Name, err)
+		return
+	}
+	t := time.NewTicker(hc.Interval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range bg.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+				defer cancel()
+				err := b.probe(ctx, b.url.ResolveReference(ref))
+				if b.health.update(hc, err) {
+					if err != nil {
+						log.Printf("backend %s of service %q is unhealthy: %v", b.url, bg.svc.Name, err)
+					} else {
+						log.Printf("backend %s of service %q is healthy", b.url, bg.svc.Name)
+						b.recovered(time.Now())
+					}
+				}
+				healthy := 0.0
+				if b.health.ok() {
+					healthy = 1
+				}
+				b.setHealthyGauge(healthy)
+			}(b)
+		}
+		wg.Wait()
+		select {
+		case <-bg.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probe sends a health check request to u through the backend transport.
+func (b *backend) probe(ctx context.Context, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "sx-healthcheck")
+	res, err := b.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return errors.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/trapped/sx"
+)
+
+func TestHealthStateUpdate(t *testing.T) {
+	hc := &sx.HealthCheck{HealthyThreshold: 2, UnhealthyThreshold: 3}
+	h := new(healthState)
+	fail := errors.New("fail")
+	for i, c := range []struct {
+		err     error
+		changed bool
+		ok      bool
+	}{
+		{fail, false, true},
+		{fail, false, true},
+		{nil, false, true}, // resets failures
+		{fail, false, true},
+		{fail, false, true},
+		{fail, true, false},
+		{fail, false, false},
+		{nil, false, false},
+		{nil, true, true},
+		{nil, false, true},
+	} {
+		if changed := h.update(hc, c.err); changed != c.changed || h.ok() != c.ok {
+			t.Errorf("step %d: changed %v ok %v, expected %v %v", i, changed, h.ok(), c.changed, c.ok)
+		}
+	}
+}
+
+func TestBackendGroupNextSkipsUnhealthy(t *testing.T) {
+	bg := &backendgroup{
+		svc:      new(sx.Service),
+		balancer: new(roundRobin),
+		backends: []*backend{{}, {}, {}},
+	}
+	bg.backends[1].health.down = 1
+	for i := 0; i < 6; i++ {
+		if bg.next(nil) == bg.backends[1] {
+			t.Fatalf("unhealthy backend selected")
+		}
+	}
+	for _, b := range bg.backends {
+		b.health.down = 1
+	}
+	if bg.next(nil) == nil {
+		t.Errorf("expected a backend even if all are unhealthy")
+	}
+}
+
+func TestBackendGroupHealthCheck(t *testing.T) {
+	var failing int32
+	var probes int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			atomic.AddInt32(&probes, 1)
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    healthcheck:
+      path: /healthz
+      interval: 10ms
+      timeout: 10ms
+      healthythreshold: 1
+      unhealthythreshold: 1
+    routes:
+      - name: root
+        path: /
+`, upstream.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	bg := g.current().serviceBackends["mock"]
+	b := bg.backends[0]
+
+	waitFor := func(ok bool) {
+		deadline := time.Now().Add(time.Second)
+		for b.health.ok() != ok {
+			if time.Now().After(deadline) {
+				t.Fatalf("backend health never became %v", ok)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	atomic.StoreInt32(&failing, 1)
+	waitFor(false)
+	if err := bg.reachable(context.Background()); err == nil {
+		t.Errorf("service should not be reachable with all backends unhealthy")
+	}
+	atomic.StoreInt32(&failing, 0)
+	waitFor(true)
+
+	// health checks stop once the group is closed
+	g.current().close()
+	time.Sleep(30 * time.Millisecond)
+	n := atomic.LoadInt32(&probes)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&probes) != n {
+		t.Errorf("health checks still running after close")
+	}
+}
+
+func TestHealthyGaugeOwnership(t *testing.T) {
+	addr := sx.Address{Address: "gauge-owner:8080", Weight: 1}
+	old, err := newBackend(nil, "gauges", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.setHealthyGauge(1)
+	// a reload rebuilds the backend with a new weight
+	addr.Weight = 2
+	b, err := newBackend(nil, "gauges", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setHealthyGauge(1)
+	old.setHealthyGauge(0)
+	old.Release()
+	if v := testutil.ToFloat64(metricBackendHealthy.WithLabelValues("gauges", b.url.String())); v != 1 {
+		t.Errorf("draining backend changed the gauge of its replacement: %v", v)
+	}
+	b.Release()
+	if metricBackendHealthy.DeleteLabelValues("gauges", b.url.String()) {
+		t.Errorf("gauge not deleted with the last backend")
+	}
+}
@@ -0,0 +1,290 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+// hedgeMinSamples is the number of upstream responses a route needs to
+// have been measured before its hedge delay is taken from its latency
+// percentile.
+const hedgeMinSamples = 100
+
+// hedgeRefresh is how often hedge delays are recomputed from latencies.
+const hedgeRefresh = time.Second
+
+// hedgeWindow is how long upstream latencies are measured for: delays are
+// estimated from the current and the previous window.
+const hedgeWindow = time.Minute
+
+// latencyBounds are the upper bounds, in seconds, of the upstream latency
+// buckets: from 1ms, each 25% wider than the previous one (up to ~1.3m).
+var latencyBounds = func() []float64 {
+	bounds := make([]float64, 80)
+	for i := range bounds {
+		bounds[i] = 0.001 * math.Pow(1.25, float64(i))
+	}
+	return bounds
+}()
+
+// latencyHistogram counts upstream response latencies in latencyBounds
+// buckets; latencies above the last bound are only counted in total.
+type latencyHistogram struct {
+	counts []uint64
+	total  uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBounds))}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if i := sort.SearchFloat64s(latencyBounds, d.Seconds()); i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.total, 1)
+}
+
+// routeLatencies measures the upstream response latencies of a route. It's
+// carried over reloads keeping the route, so that they don't reset it.
+type routeLatencies struct {
+	// *latencyHistogram of the current and previous hedgeWindow
+	cur, prev atomic.Value
+
+	mu      sync.Mutex
+	rotated time.Time
+}
+
+func newRouteLatencies(now time.Time) *routeLatencies {
+	l := &routeLatencies{rotated: now}
+	l.cur.Store(newLatencyHistogram())
+	l.prev.Store(newLatencyHistogram())
+	return l
+}
+
+func (l *routeLatencies) observe(d time.Duration) {
+	l.cur.Load().(*latencyHistogram).observe(d)
+}
+
+// quantile estimates the q quantile of the latencies measured in the
+// current and previous windows. It returns false if fewer than
+// hedgeMinSamples responses were measured.
+func (l *routeLatencies) quantile(q float64, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.rotated) >= hedgeWindow {
+		l.prev.Store(l.cur.Load())
+		l.cur.Store(newLatencyHistogram())
+		l.rotated = now
+	}
+	cur := l.cur.Load().(*latencyHistogram)
+	prev := l.prev.Load().(*latencyHistogram)
+	counts := make([]uint64, len(latencyBounds))
+	var cumulative uint64
+	for i := range counts {
+		cumulative += atomic.LoadUint64(&cur.counts[i]) + atomic.LoadUint64(&prev.counts[i])
+		counts[i] = cumulative
+	}
+	total := atomic.LoadUint64(&cur.total) + atomic.LoadUint64(&prev.total)
+	if total < hedgeMinSamples {
+		return 0, false
+	}
+	return time.Duration(histogramQuantile(q, latencyBounds, counts, total) * float64(time.Second)), true
+}
+
+// hedgeDelay caches the hedge delay of a route hedging at a latency
+// percentile.
+type hedgeDelay struct {
+	rg        *sx.RouteGroup
+	latencies *routeLatencies
+
+	mu      sync.Mutex
+	delay   time.Duration
+	updated time.Time
+}
+
+func (h *hedgeDelay) get(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.updated) >= hedgeRefresh {
+		h.delay = h.rg.Hedge.Delay
+		if q, ok := h.latencies.quantile(h.rg.Hedge.Percentile, now); ok && q > h.delay {
+			h.delay = q
+		}
+		h.updated = now
+	}
+	return h.delay
+}
+
+// hedgeDelay returns the delay after which requests to rg are hedged, 0
+// if they aren't.
+func (st *state) hedgeDelay(rg *sx.RouteGroup) time.Duration {
+	if h, ok := st.hedges[rg]; ok {
+		return h.get(time.Now())
+	}
+	return rg.Hedge.Delay
+}
+
+// observeLatency measures the latency of an upstream response to rg, if it
+// hedges at a latency percentile. Errors and error statuses aren't
+// measured.
+func (st *state) observeLatency(rg *sx.RouteGroup, res *http.Response, err error, latency time.Duration) {
+	if h, ok := st.hedges[rg]; ok && err == nil && res.StatusCode < 400 {
+		h.latencies.observe(latency)
+	}
+}
+
+// routeLatencies returns the upstream latencies measured by st for the
+// route of rg, if any.
+func (st *state) routeLatencies(rg *sx.RouteGroup) *routeLatencies {
+	if st == nil {
+		return nil
+	}
+	for r, h := range st.hedges {
+		if r.ParentService.Name == rg.ParentService.Name && r.Name == rg.Name && r.AbsolutePath() == rg.AbsolutePath() {
+			return h.latencies
+		}
+	}
+	return nil
+}
+
+// histogramQuantile estimates the q quantile of a histogram from its
+// cumulative bucket counts, interpolating linearly within the bucket like
+// PromQL histogram_quantile. Quantiles above the last bucket are capped to
+// its upper bound.
+func histogramQuantile(q float64, bounds []float64, counts []uint64, total uint64) float64 {
+	rank := q * float64(total)
+	lower, lowerCount := 0.0, 0.0
+	for i, upper := range bounds {
+		count := float64(counts[i])
+		if count >= rank && count > lowerCount {
+			return lower + (upper-lower)*(rank-lowerCount)/(count-lowerCount)
+		}
+		lower, lowerCount = upper, count
+	}
+	if len(bounds) == 0 {
+		return math.NaN()
+	}
+	return bounds[len(bounds)-1]
+}
+
+// hedgeResult is the outcome of a request sent to a backend.
+type hedgeResult struct {
+	b       *backend
+	res     *http.Response
+	err     error
+	latency time.Duration
+}
+
+// send sends req to the request backend. If hedged, it's sent again to
+// another backend once the route hedge delay elapses without response
+// headers, using whichever response arrives first and cancelling the
+// other request. body is the buffered request body, if any.
+func (ctx *sxCtx) send(req *http.Request, body []byte, timeout time.Duration, hedged bool) (*http.Response, error) {
+	setBody(req, body)
+	b := ctx.backend
+	var delay time.Duration
+	if hedged {
+		delay = ctx.state.hedgeDelay(ctx.route.RouteGroup)
+	}
+	if delay <= 0 {
+		start := time.Now()
+		res, err := b.try(req, timeout)
+		ctx.state.observeLatency(ctx.route.RouteGroup, res, err, time.Since(start))
+		return res, err
+	}
+	results := make(chan hedgeResult, 2)
+	start := func(b *backend, req *http.Request) context.CancelFunc {
+		actx, cancel := context.WithCancel(req.Context())
+		go func() {
+			start := time.Now()
+			res, err := b.try(req.WithContext(actx), timeout)
+			results <- hedgeResult{b: b, res: res, err: err, latency: time.Since(start)}
+		}()
+		return cancel
+	}
+	cancels := map[*backend]context.CancelFunc{b: start(b, req)}
+	pending := 1
+	hedge := time.NewTimer(delay)
+	defer hedge.Stop()
+	for {
+		select {
+		case <-hedge.C:
+			h := ctx.group.retryBackend(req, []*backend{b})
+			if h == nil || h == b {
+				continue
+			}
+			labels := routeLabels(ctx.route.RouteGroup, req.Method)
+			if !ctx.state.budget.retry(time.Now()) {
+				metricRouteRetryBudgetExhausted.WithLabelValues(labels...).Inc()
+				continue
+			}
+			metricRouteHedges.WithLabelValues(labels...).Inc()
+			h.begin()
+			hreq := retarget(req, b, h)
+			setBody(hreq, body)
+			cancels[h] = start(h, hreq)
+			pending++
+		case a := <-results:
+			pending--
+			if a.err != nil && pending > 0 {
+				// wait for the other request
+				if req.Context().Err() == nil {
+					ctx.group.observe(a.b, 0, a.err)
+				}
+				if a.b != b {
+					a.b.end()
+				}
+				continue
+			}
+			ctx.state.observeLatency(ctx.route.RouteGroup, a.res, a.err, a.latency)
+			for hb, cancel := range cancels {
+				if hb != a.b {
+					cancel()
+				}
+			}
+			go drain(results, pending, b)
+			if a.b != b {
+				ctx.switchBackend(a.b)
+				a.b.end()
+			}
+			if a.err != nil {
+				cancels[a.b]()
+				return nil, a.err
+			}
+			// the body is still streamed with the request context
+			a.res.Body = &cancelBody{a.res.Body, cancels[a.b]}
+			return a.res, nil
+		}
+	}
+}
+
+// drain discards the n cancelled requests still pending on results,
+// sent to backends other than primary.
+func drain(results <-chan hedgeResult, n int, primary *backend) {
+	for i := 0; i < n; i++ {
+		a := <-results
+		if a.res != nil {
+			a.res.Body.Close()
+		}
+		if a.b != primary {
+			a.b.end()
+		}
+	}
+}
+
+// setBody sets the body of req to a new reader of body, if any.
+func setBody(req *http.Request, body []byte) {
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+}
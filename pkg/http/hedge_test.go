@@ -0,0 +1,155 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	bounds := []float64{0.1, 0.2, 0.5}
+	counts := []uint64{50, 90, 100}
+	for _, c := range []struct {
+		q, expected float64
+	}{
+		{0.25, 0.05},
+		{0.5, 0.1},
+		{0.7, 0.15},
+		{0.95, 0.35},
+		{1, 0.5},
+	} {
+		if v := histogramQuantile(c.q, bounds, counts, 100); v < c.expected-1e-9 || v > c.expected+1e-9 {
+			t.Errorf("quantile %v: expected %v, got %v", c.q, c.expected, v)
+		}
+	}
+	// samples above the last bucket
+	if v := histogramQuantile(0.99, bounds, counts, 110); v != 0.5 {
+		t.Errorf("quantile above the last bucket: expected 0.5, got %v", v)
+	}
+}
+
+func TestRouteLatencies(t *testing.T) {
+	now := time.Now()
+	l := newRouteLatencies(now)
+	if _, ok := l.quantile(0.9, now); ok {
+		t.Fatalf("latency estimated without samples")
+	}
+	for i := 0; i < hedgeMinSamples; i++ {
+		l.observe(15 * time.Millisecond)
+	}
+	// within the 25% resolution of the buckets
+	q, ok := l.quantile(0.9, now)
+	if !ok || q < 14*time.Millisecond || q > 19*time.Millisecond {
+		t.Errorf("bad latency estimate: %v %v", q, ok)
+	}
+	// samples are kept for the previous window...
+	if _, ok := l.quantile(0.9, now.Add(hedgeWindow)); !ok {
+		t.Errorf("previous window samples discarded")
+	}
+	// ...but not older ones
+	if _, ok := l.quantile(0.9, now.Add(2*hedgeWindow)); ok {
+		t.Errorf("old samples still used")
+	}
+}
+
+func TestObserveLatency(t *testing.T) {
+	svc := &sx.Service{Name: "latency"}
+	rg := &sx.RouteGroup{ParentService: svc, Name: "root", Path: "/*"}
+	st := &state{hedges: map[*sx.RouteGroup]*hedgeDelay{
+		rg: {rg: rg, latencies: newRouteLatencies(time.Now())},
+	}}
+	for _, c := range []struct {
+		res *http.Response
+		err error
+	}{
+		{&http.Response{StatusCode: 200}, nil},
+		{&http.Response{StatusCode: 503}, nil},
+		{nil, fmt.Errorf("connection refused")},
+	} {
+		st.observeLatency(rg, c.res, c.err, time.Millisecond)
+	}
+	if n := st.hedges[rg].latencies.cur.Load().(*latencyHistogram).total; n != 1 {
+		t.Errorf("expected only the successful response measured, got %d", n)
+	}
+	// a reload keeping the route keeps its latencies
+	same := &sx.RouteGroup{ParentService: &sx.Service{Name: "latency"}, Name: "root", Path: "/*"}
+	if st.routeLatencies(same) != st.hedges[rg].latencies {
+		t.Errorf("latencies not carried over")
+	}
+	other := &sx.RouteGroup{ParentService: svc, Name: "other", Path: "/*"}
+	if st.routeLatencies(other) != nil {
+		t.Errorf("latencies shared with another route")
+	}
+}
+
+func TestGatewayHedge(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s", "%s"]
+    routes:
+      - name: root
+        path: /*
+        hedge:
+          delay: 20ms
+`, slow.Listener.Addr(), fast.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		res, err := http.Get(gw.URL + "/mock/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "fast" || time.Since(start) > 500*time.Millisecond {
+			t.Errorf("request %d not hedged: %q after %s", i, body, time.Since(start))
+		}
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Errorf("hedged request to the slow backend not cancelled")
+	}
+	for _, b := range g.current().serviceBackends["mock"].backends {
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&b.inflight) != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := atomic.LoadInt64(&b.inflight); n != 0 {
+			t.Errorf("backend %s left with %d requests in flight", b.url, n)
+		}
+	}
+}
@@ -9,13 +9,14 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/trapped/sx"
-	"github.com/trapped/sx/pkg/redis"
+	"github.com/trapped/sx/pkg/breaker"
 )
 
 var (
@@ -46,6 +47,57 @@ var (
 		Help:      "Histogram of SetResponse duration buckets and total calls count",
 		Buckets:   metricLatencyDefaultBuckets,
 	}, []string{"service", "route", "path", "method"})
+	// ratelimit
+	metricRateLimitCheck = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sx",
+		Subsystem: "ratelimit",
+		Name:      "check",
+		Help:      "Histogram of rate limit check duration buckets and total calls count",
+		Buckets:   metricLatencyDefaultBuckets,
+	}, []string{"service", "route", "path", "method"})
+	metricRateLimitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sx",
+		Subsystem: "ratelimit",
+		Name:      "rejected",
+		Help:      "Count of requests rejected by rate limits",
+	}, []string{"service", "route", "path", "method"})
+	// backend
+	metricBackendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sx",
+		Subsystem: "backend",
+		Name:      "healthy",
+		Help:      "Whether a backend passes active health checks (1) or not (0)",
+	}, []string{"service", "backend"})
+	metricBackendEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sx",
+		Subsystem: "backend",
+		Name:      "ejections",
+		Help:      "Count of backend ejections by outlier detection",
+	}, []string{"service", "backend"})
+	metricRouteRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sx",
+		Subsystem: "route",
+		Name:      "retries",
+		Help:      "Count of upstream requests retried",
+	}, []string{"service", "route", "path", "method"})
+	metricRouteRetryBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sx",
+		Subsystem: "route",
+		Name:      "retry_budget_exhausted",
+		Help:      "Count of retries and hedged requests skipped because the retry budget was exhausted",
+	}, []string{"service", "route", "path", "method"})
+	metricRouteHedges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sx",
+		Subsystem: "route",
+		Name:      "hedges",
+		Help:      "Count of hedged upstream requests",
+	}, []string{"service", "route", "path", "method"})
+	metricRouteTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sx",
+		Subsystem: "route",
+		Name:      "timeouts",
+		Help:      "Count of upstream requests failed by a connect, header or total timeout, or the client deadline",
+	}, []string{"service", "route", "path", "method", "timeout"})
 	// request
 	metricRouteRequest = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "sx",
@@ -56,36 +108,84 @@ var (
 	}, []string{"service", "route", "path", "method", "status"})
 )
 
+// routeLabels returns the service, route, path and method labels of the
+// route metrics of a request to rg.
+func routeLabels(rg *sx.RouteGroup, method string) []string {
+	return []string{rg.ParentService.Name, rg.Name, rg.AbsolutePath(), method}
+}
+
 // sxCtx is the context value added to request contexts.
 type sxCtx struct {
+	state       *state
 	route       *sx.Route
+	group       *backendgroup
+	backend     *backend
 	originalURL *url.URL
 	cacheKey    string
 	cached      bool
 	startTime   time.Time
+	// upstream response status (0 if it failed) and time to headers
+	upstreamStart   time.Time
+	upstreamStatus  int
+	upstreamLatency time.Duration
+	// set if the upstream request deadline was set by the client, and if
+	// the upstream request failed because of the client
+	clientDeadline bool
+	clientFault    bool
 }
 
 // sxCtxKey is the key used for setting and retrieving sxCtx from request contexts.
 var sxCtxKey sxCtx
 
 type Gateway struct {
-	routes          []sx.Route
-	serviceBackends map[string]*backendgroup
-	redis           *redis.Client
-	s               *http.Server
+	// state holds the current *state, swapped atomically on reload
+	state atomic.Value
+	// inflight counts requests being served, including hijacked ones
+	inflight int64
+	// mu guards s and serializes configuration loads
+	mu sync.Mutex
+	s  *http.Server
+}
+
+// current returns the currently loaded state, or nil if no configuration
+// was loaded yet.
+func (g *Gateway) current() *state {
+	st, _ := g.state.Load().(*state)
+	return st
 }
 
-func (g *Gateway) match(path string) *sx.Route {
-	for i := 0; i < len(g.routes); i++ {
-		r := &g.routes[i]
-		if r.Match(path) {
-			return r
+// acquire returns the current state, which must be released once the
+// request is done with it. It returns nil if no configuration was loaded
+// yet.
+func (g *Gateway) acquire() *state {
+	for {
+		st := g.current()
+		if st == nil {
+			return nil
 		}
+		st.gen.Acquire()
+		if g.current() == st {
+			return st
+		}
+		// swapped in the meantime, the state may already be closed
+		st.gen.Release()
 	}
-	return nil
 }
 
-func writeError(w http.ResponseWriter, e sx.Error) {
+// writeError replies to r with e, in the error format of st (JSON if no
+// configuration was loaded yet).
+func writeError(w http.ResponseWriter, r *http.Request, st *state, e sx.Error) {
+	e.RequestID = r.Header.Get(sx.RequestIDHeader)
+	if st != nil && st.conf.Errors.Format == sx.ErrorFormatProblem {
+		instance := r.URL.Path
+		if ctx, ok := r.Context().Value(sxCtxKey).(*sxCtx); ok {
+			instance = ctx.originalURL.Path
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(e.Code)
+		json.NewEncoder(w).Encode(e.Problem(instance))
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(e.Code)
 	json.NewEncoder(w).Encode(e)
@@ -93,43 +193,57 @@ func writeError(w http.ResponseWriter, e sx.Error) {
 
 // LoadConfig configures the Gateway to use a new configuration.
 // If the gateway was already running, it will start using the new
-// configuration for new requests.
+// configuration for new requests, while in-flight requests complete
+// with the previous one. Only services whose backends changed are
+// rebuilt, reusing unchanged backends; backends that were removed stop
+// getting requests, and their connections are closed once their
+// in-flight requests are done.
 func (g *Gateway) LoadConfig(conf *sx.GatewayConfig) error {
-	newroutes := make([]sx.Route, 0)
-	serviceBackends := make(map[string]*backendgroup)
-	for i := 0; i < len(conf.Services); i++ {
-		svc := conf.Services[i]
-		if bg, err := newBackendGroup(g, svc.Addresses); err != nil {
-			return errors.Wrapf(err, "in service %q", svc.Name)
-		} else {
-			serviceBackends[svc.Name] = bg
-		}
-		svcRoutes, err := svc.CompileRoutes()
-		if err != nil {
-			return errors.Wrapf(err, "in service %q", svc.Name)
-		}
-		newroutes = append(newroutes, svcRoutes...)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	prev := g.current()
+	st, err := newState(g, prev, conf)
+	if err != nil {
+		return err
+	}
+	g.state.Store(st)
+	if prev != nil {
+		prev.retireRemovedBackends(st)
+		prev.gen.Retire()
+		log.Printf("configuration reloaded: %s", sx.DiffConfig(prev.conf, conf))
 	}
-	// XXX: swap, definitely unsafe
-	g.routes = newroutes
-	g.serviceBackends = serviceBackends
-	g.redis = redis.NewClient(conf.Redis)
 	return nil
 }
 
-func (g *Gateway) authorize(rg *sx.RouteGroup, r *http.Request) bool {
+// authorize checks the credentials of r against the route auth. Requests
+// without credentials fail with ErrorUnauthorized, along with the
+// challenge for the WWW-Authenticate header; requests whose credentials
+// are rejected fail with ErrorForbidden.
+func (g *Gateway) authorize(rg *sx.RouteGroup, r *http.Request) (e sx.Error, challenge string, ok bool) {
 	if rg.Auth == nil {
-		return true
+		return sx.Error{}, "", true
 	}
+	realm := strconv.Quote(rg.ParentService.Name)
 	if rg.Auth.Basic != nil {
 		username, password, ok := r.BasicAuth()
-		return ok || rg.Auth.Basic.Verify(username, password)
+		if !ok {
+			return sx.ErrorUnauthorized, "Basic realm=" + realm, false
+		}
+		if !rg.Auth.Basic.Verify(username, password) {
+			return sx.ErrorForbidden, "", false
+		}
+		return sx.Error{}, "", true
 	}
 	if rg.Auth.Bearer != nil {
-		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-		return rg.Auth.Bearer.Verify(token) == nil
+		auth := r.Header.Get("Authorization")
+		if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+			return sx.ErrorUnauthorized, "Bearer realm=" + realm, false
+		}
+		if rg.Auth.Bearer.Verify(auth[len("Bearer "):]) != nil {
+			return sx.ErrorForbidden, "", false
+		}
 	}
-	return true
+	return sx.Error{}, "", true
 }
 
 type httpCacheKeyExtractor struct {
@@ -144,6 +258,48 @@ func (x *httpCacheKeyExtractor) ExtractQuery(name string) string {
 	return x.r.URL.Query().Get(name)
 }
 
+func (x *httpCacheKeyExtractor) ExtractCookie(name string) string {
+	c, err := x.r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// rateLimit counts the request against the route rate limits, partitioned
+// by the configured keys. Requests are allowed through if the store can't
+// be reached, in which case ok is false.
+func (g *Gateway) rateLimit(st *state, rt *sx.Route, r *http.Request) (res sx.RateLimitResult, ok bool) {
+	rl := rt.RouteGroup.RateLimit
+	// prepare rate limit key
+	key := st.store.MakeKey(
+		"ratelimit",
+		rt.Pattern,
+		sx.CacheKeySet(rl.Keys).Extract(&httpCacheKeyExtractor{r}))
+	// record timing of rate limit check
+	checkStart := time.Now()
+	res, err := st.store.RateLimit(r.Context(), key, rl.Algorithm, rl.Windows(), checkStart)
+	metricRateLimitCheck.WithLabelValues(
+		rt.RouteGroup.ParentService.Name,
+		rt.RouteGroup.Name,
+		rt.RouteGroup.AbsolutePath(),
+		r.Method,
+	).Observe(float64(time.Since(checkStart).Seconds()))
+	if err != nil {
+		log.Printf("rate limit error, allowing request: %v", err)
+		return sx.RateLimitResult{Allowed: true}, false
+	}
+	if !res.Allowed {
+		metricRateLimitRejected.WithLabelValues(
+			rt.RouteGroup.ParentService.Name,
+			rt.RouteGroup.Name,
+			rt.RouteGroup.AbsolutePath(),
+			r.Method,
+		).Inc()
+	}
+	return res, true
+}
+
 func (g *Gateway) postResponse(req *http.Request, res *http.Response) error {
 	// get context
 	ctx := req.Context().Value(sxCtxKey).(*sxCtx)
@@ -151,7 +307,7 @@ func (g *Gateway) postResponse(req *http.Request, res *http.Response) error {
 	if ctx.route.RouteGroup.Cache != nil && !ctx.cached && res.StatusCode < 400 {
 		// set response in cache
 		setResponseStart := time.Now()
-		g.redis.SetResponse(req.Context(), ctx.cacheKey, res, ctx.route.RouteGroup.Cache.TTL)
+		ctx.state.store.SetResponse(req.Context(), ctx.cacheKey, res, ctx.route.RouteGroup.Cache.TTL)
 		metricCacheSetResponse.WithLabelValues(
 			ctx.route.RouteGroup.ParentService.Name,
 			ctx.route.RouteGroup.Name,
@@ -170,11 +326,13 @@ func (g *Gateway) postResponse(req *http.Request, res *http.Response) error {
 	return nil
 }
 
-func (g *Gateway) rewriteRequest(rt *sx.Route, b *backend, r *http.Request) *http.Request {
+func (g *Gateway) rewriteRequest(st *state, rt *sx.Route, b *backend, r *http.Request) *http.Request {
 	// store values in context
 	originalURL := *r.URL
 	ctxVal := sxCtx{
+		state:       st,
 		route:       rt,
+		group:       st.serviceBackends[rt.RouteGroup.ParentService.Name],
 		originalURL: &originalURL,
 		startTime:   time.Now(),
 	}
@@ -193,13 +351,13 @@ func (g *Gateway) tryServeCache(rt *sx.Route, w http.ResponseWriter, r *http.Req
 	// get context
 	ctx := r.Context().Value(sxCtxKey).(*sxCtx)
 	// prepare cache key
-	ctx.cacheKey = g.redis.MakeKey(
+	ctx.cacheKey = ctx.state.store.MakeKey(
 		"resp",
 		ctx.originalURL.Path,
 		sx.CacheKeySet(rt.RouteGroup.Cache.Keys).Extract(&httpCacheKeyExtractor{r}))
 	// record timing of cache fetch
 	getResponseStart := time.Now()
-	resp, ok = g.redis.GetResponse(r.Context(), ctx.cacheKey)
+	resp, ok = ctx.state.store.GetResponse(r.Context(), ctx.cacheKey)
 	metricCacheGetResponse.WithLabelValues(
 		rt.RouteGroup.ParentService.Name,
 		rt.RouteGroup.Name,
@@ -229,31 +387,67 @@ func (g *Gateway) tryServeCache(rt *sx.Route, w http.ResponseWriter, r *http.Req
 
 // ServeHTTP implements the standard Go HTTP interface.
 func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	rt := g.match(r.URL.Path)
-	if rt == nil || rt.RouteGroup == nil {
-		writeError(w, sx.ErrorNotFound)
+	atomic.AddInt64(&g.inflight, 1)
+	defer atomic.AddInt64(&g.inflight, -1)
+	// identify the request to the upstream and in the response
+	id := sx.RequestID(r.Header.Get(sx.RequestIDHeader))
+	r.Header.Set(sx.RequestIDHeader, id)
+	w.Header().Set(sx.RequestIDHeader, id)
+	// pin the request to the current state
+	st := g.acquire()
+	if st == nil {
+		w.Header().Set("Retry-After", sx.NotLoadedRetryAfter)
+		writeError(w, r, nil, sx.ErrorServiceUnavailable)
 		return
 	}
-	if !g.authorize(rt.RouteGroup, r) {
-		writeError(w, sx.ErrorForbidden)
+	defer st.gen.Release()
+	rt, allowed := st.match(r.Method, r.URL.Path)
+	if rt == nil && len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, r, st, sx.ErrorBadMethod)
 		return
 	}
-	if rt.RouteGroup.Method != "" && r.Method != rt.RouteGroup.Method {
-		writeError(w, sx.ErrorBadMethod)
+	if rt == nil {
+		writeError(w, r, st, sx.ErrorNotFound)
 		return
 	}
+	if e, challenge, ok := g.authorize(rt.RouteGroup, r); !ok {
+		if challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		writeError(w, r, st, e)
+		return
+	}
+	if max := rt.RouteGroup.MaxBodyBytes; max > 0 && r.Body != nil {
+		if r.ContentLength > max {
+			writeError(w, r, st, sx.ErrorPayloadTooLarge)
+			return
+		}
+		r.Body = &limitedBody{r.Body, max}
+	}
+	// check rate limit
+	if rt.RouteGroup.RateLimit != nil {
+		res, ok := g.rateLimit(st, rt, r)
+		if ok {
+			res.SetHeaders(w.Header())
+		}
+		if !res.Allowed {
+			writeError(w, r, st, sx.ErrorTooManyRequests)
+			return
+		}
+	}
 	// get next backend to proxy request to
-	b := g.serviceBackends[rt.RouteGroup.ParentService.Name].next()
+	bg := st.serviceBackends[rt.RouteGroup.ParentService.Name]
+	b := bg.backendFor(w, r)
 	if b == nil {
-		writeError(w, sx.ErrorBadGateway)
+		writeError(w, r, st, sx.ErrorBadGateway)
 		return
 	}
 	// TODO: set SX values in context rather than headers
 	// rewrite request
-	r = g.rewriteRequest(rt, b, r)
+	r = g.rewriteRequest(st, rt, b, r)
 	ctx := r.Context().Value(sxCtxKey).(*sxCtx)
 
-	// TODO: check rate limit
 	// try serving from cache
 	if rt.RouteGroup.Cache != nil {
 		if resp, ok := g.tryServeCache(rt, w, r); ok {
@@ -262,9 +456,42 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	// the upstream request is bound by the route total timeout and the
+	// client deadline
+	deadline, fromClient, hasDeadline := requestDeadline(st.conf, rt, r, time.Now())
+	if fromClient && !deadline.After(time.Now()) {
+		metricRouteTimeouts.WithLabelValues(append(routeLabels(rt.RouteGroup, r.Method), "deadline")...).Inc()
+		writeError(w, r, st, sx.ErrorGatewayTimeout)
+		return
+	}
+	ctx.clientDeadline = fromClient
+	// fail fast while the service circuit breaker is open
+	if bg.breaker != nil {
+		done, ok := bg.breaker.Allow()
+		if !ok {
+			writeError(w, r, st, sx.ErrorServiceUnavailable)
+			return
+		}
+		// deferred, since failing to stream the response aborts the handler
+		client := r.Context()
+		defer func() {
+			// the client going away isn't the upstream's fault
+			if ctx.upstreamStatus == 0 && (client.Err() != nil || ctx.clientFault) {
+				done(breaker.Ignored)
+				return
+			}
+			done(bg.breaker.Result(ctx.upstreamStatus, ctx.upstreamLatency))
+		}()
+	}
+	if hasDeadline {
+		dctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		r = r.WithContext(dctx)
+	}
 	// forward request to upstream
 	log.Printf("%s %s -> %s", r.Method, ctx.originalURL, r.URL)
-	b.proxy.ServeHTTP(w, r)
+	ctx.upstreamStart = time.Now()
+	b.serve(w, r)
 }
 
 // ListenAndServe is the entrypoint to run the Gateway.
@@ -273,14 +500,44 @@ func (g *Gateway) ListenAndServe(addr string) error {
 		Addr:    addr,
 		Handler: g,
 	}
+	g.mu.Lock()
 	g.s = s
+	g.mu.Unlock()
 	return s.ListenAndServe()
 }
 
-// Shutdown gracefully stops the gateway.
+// Shutdown gracefully stops the gateway: it stops accepting connections,
+// then waits for in-flight requests to complete, including streams and
+// upgraded connections (e.g. WebSockets). If ctx is done first, remaining
+// connections are closed and ctx.Err() is returned.
 func (g *Gateway) Shutdown(ctx context.Context) error {
-	if g.s != nil {
-		return g.s.Shutdown(ctx)
+	g.mu.Lock()
+	s := g.s
+	g.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	err := s.Shutdown(ctx)
+	if err == nil {
+		// http.Server doesn't track hijacked connections
+		err = g.drain(ctx)
+	}
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
+
+// drain waits until no requests are in flight, or ctx is done.
+func (g *Gateway) drain(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&g.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
 	return nil
 }
@@ -2,14 +2,21 @@ package http
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/trapped/sx"
 )
 
@@ -36,6 +43,18 @@ func (m *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello world!"))
 }
 
+// waitListening blocks until addr accepts connections.
+func waitListening(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("gateway not listening at %s", addr)
+}
+
 func TestGatewayMock(t *testing.T) {
 	mock := httptest.NewServer(new(mockServer))
 	defer mock.Close()
@@ -47,6 +66,7 @@ func TestGatewayMock(t *testing.T) {
 		}
 	}()
 	defer g.Shutdown(context.Background())
+	waitListening(t, "localhost:7655")
 
 	conf := new(sx.GatewayConfig)
 	err := conf.Read(strings.NewReader(fmt.Sprintf(`
@@ -106,17 +126,563 @@ services:
 		return
 	}
 
-	resp, err = http.Get("http://localhost:7655/mock/")
+	for _, c := range []struct {
+		username, password string
+		status             int
+	}{
+		{"", "", 401},
+		{"test", "wrong", 403},
+		{"test", "test", 200},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost:7655/mock/", nil)
+		if c.username != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed fetching root: %v", err)
+		}
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%q: bad status code: %d", c.username, resp.StatusCode)
+		}
+		switch c.status {
+		case 401:
+			checkError(t, body, sx.ErrorUnauthorized)
+			if h := resp.Header.Get("WWW-Authenticate"); h != `Basic realm="mock"` {
+				t.Errorf("bad WWW-Authenticate header: %q", h)
+			}
+		case 403:
+			checkError(t, body, sx.ErrorForbidden)
+		}
+	}
+}
+
+// checkError checks that body is the JSON of expected, with a request ID.
+func checkError(t *testing.T, body []byte, expected sx.Error) {
+	t.Helper()
+	var e sx.Error
+	if err := json.Unmarshal(body, &e); err != nil || e.Code != expected.Code || e.Message != expected.Message || e.RequestID == "" {
+		t.Errorf("bad error body: %q", body)
+	}
+}
+
+func TestGatewayRateLimit(t *testing.T) {
+	mock := httptest.NewServer(new(mockServer))
+	defer mock.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root
+        method: GET
+        path: /
+        ratelimit:
+          minute: 2
+          keys:
+            - header: X-Api-Key
+`, mock.Listener.Addr())))
 	if err != nil {
-		t.Errorf("failed fetching root: %v", err)
+		t.Fatalf("failed reading configuration: %v", err)
 	}
-	if resp.StatusCode != 401 {
-		t.Errorf("bad status code: %v", err)
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	get := func(key string) *http.Response {
+		req, _ := http.NewRequest("GET", gw.URL+"/mock/", nil)
+		req.Header.Set("X-Api-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed fetching root: %v", err)
+		}
+		resp.Body.Close()
+		return resp
 	}
-	body, err = ioutil.ReadAll(resp.Body)
+	for i := 0; i < 2; i++ {
+		resp := get("a")
+		if resp.StatusCode != 200 {
+			t.Errorf("bad status code: %v", resp.StatusCode)
+		}
+		if resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Errorf("bad rate limit headers: %v", resp.Header)
+		}
+	}
+	resp := get("a")
+	if resp.StatusCode != 429 {
+		t.Errorf("bad status code: %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Errorf("missing Retry-After header: %v", resp.Header)
+	}
+	// other keys have their own counters
+	if resp := get("b"); resp.StatusCode != 200 {
+		t.Errorf("bad status code: %v", resp.StatusCode)
+	}
+}
+
+func TestGatewayRedisRateLimit(t *testing.T) {
+	mock := httptest.NewServer(new(mockServer))
+	defer mock.Close()
+	redis := miniredis.RunT(t)
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+redis:
+  readaddresses: ["%s"]
+  writeaddresses: ["%s"]
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root
+        method: GET
+        path: /
+        ratelimit:
+          minute: 2
+          keys:
+            - header: X-Api-Key
+`, redis.Addr(), redis.Addr(), mock.Listener.Addr())))
 	if err != nil {
-		t.Errorf("error reading body: %v", err)
-	} else if string(body) != "{\"code\":401,\"message\":\"forbidden\"}\n" {
-		t.Errorf("bad body: %v", string(body))
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	get := func() *http.Response {
+		req, _ := http.NewRequest("GET", gw.URL+"/mock/", nil)
+		req.Header.Set("X-Api-Key", "a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed fetching root: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := get(); resp.StatusCode != 200 || resp.Header.Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Errorf("request %d: bad response: %d %v", i, resp.StatusCode, resp.Header)
+		}
+	}
+	if resp := get(); resp.StatusCode != 429 {
+		t.Errorf("bad status code: %v", resp.StatusCode)
+	}
+	// the counters live in redis, shared by every gateway
+	if len(redis.Keys()) == 0 {
+		t.Errorf("rate limit not counted in redis")
+	}
+	redis.FlushAll()
+	if resp := get(); resp.StatusCode != 200 {
+		t.Errorf("bad status code after flushing redis: %v", resp.StatusCode)
+	}
+}
+
+func TestGatewayConcurrentReload(t *testing.T) {
+	mock := httptest.NewServer(new(mockServer))
+	defer mock.Close()
+
+	confs := make([]*sx.GatewayConfig, 2)
+	for i := range confs {
+		confs[i] = new(sx.GatewayConfig)
+		err := confs[i].Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root%d
+        method: GET
+        path: /
+        cache:
+          ttl: 1s
+`, mock.Listener.Addr(), i)))
+		if err != nil {
+			t.Fatalf("failed reading configuration: %v", err)
+		}
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(confs[0]); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := g.LoadConfig(confs[i%2]); err != nil {
+				t.Errorf("failed loading configuration: %v", err)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				resp, err := http.Get(gw.URL + "/mock/")
+				if err != nil {
+					t.Errorf("failed fetching root: %v", err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != 200 {
+					t.Errorf("bad status code: %v", resp.StatusCode)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-reloaded
+}
+
+func TestGatewayReloadResources(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	mock := httptest.NewServer(new(mockServer))
+	defer mock.Close()
+
+	read := func(addr string) *sx.GatewayConfig {
+		conf := new(sx.GatewayConfig)
+		err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /
+  - name: other
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /
+`, addr, mock.Listener.Addr())))
+		if err != nil {
+			t.Fatalf("failed reading configuration: %v", err)
+		}
+		return conf
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(read(slow.Listener.Addr().String())); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+	first := g.current()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(gw.URL + "/mock/")
+		if err != nil {
+			t.Errorf("failed fetching root: %v", err)
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "slow" {
+			t.Errorf("bad body: %v", string(body))
+		}
+	}()
+	<-started
+
+	if err := g.LoadConfig(read(mock.Listener.Addr().String())); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	second := g.current()
+	if second.store != first.store || second.serviceBackends["other"] != first.serviceBackends["other"] {
+		t.Errorf("unchanged resources were not reused")
+	}
+	if second.serviceBackends["mock"] == first.serviceBackends["mock"] {
+		t.Errorf("changed backend group was reused")
+	}
+	if first.serviceBackends["mock"].Closed() {
+		t.Errorf("backend group closed with requests in flight")
+	}
+	close(release)
+	<-done
+	// the handler may still be returning
+	for i := 0; i < 100 && !first.serviceBackends["mock"].Closed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !first.serviceBackends["mock"].Closed() {
+		t.Errorf("backend group not closed after draining")
+	}
+	if first.serviceBackends["other"].Closed() || first.store.Closed() {
+		t.Errorf("reused resources were closed")
+	}
+}
+
+func TestGatewayShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// stream the response in two parts
+		w.Write([]byte("Hello "))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("world!"))
+	}))
+	defer slow.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: slow
+    addresses: ["%s"]
+    routes:
+      - name: root
+        path: /
+`, slow.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	go func() {
+		if err := g.ListenAndServe(":7656"); err != nil && err != http.ErrServerClosed {
+			t.Errorf("failed to run gateway: %v", err)
+		}
+	}()
+	waitListening(t, "localhost:7656")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get("http://localhost:7656/slow/")
+		if err != nil {
+			t.Errorf("failed fetching root: %v", err)
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "Hello world!" {
+			t.Errorf("bad body: %v", string(body))
+		}
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- g.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with requests in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := net.Dial("tcp", "localhost:7656"); err == nil {
+		t.Errorf("gateway still accepting connections while shutting down")
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("failed shutting down: %v", err)
+	}
+	<-done
+}
+
+func TestGatewayCircuitBreaker(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    circuitbreaker:
+      minrequests: 3
+      openduration: 1m
+    routes:
+      - name: root
+        path: /*
+`, upstream.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	for i := 0; i < 4; i++ {
+		res, err := http.Get(gw.URL + "/mock/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		expected := http.StatusInternalServerError
+		if i == 3 {
+			expected = http.StatusServiceUnavailable
+			checkError(t, body, sx.ErrorServiceUnavailable)
+		}
+		if res.StatusCode != expected {
+			t.Errorf("request %d: expected status %d, got %d", i, expected, res.StatusCode)
+		}
+	}
+}
+
+func TestGatewayNotLoaded(t *testing.T) {
+	rec := httptest.NewRecorder()
+	new(Gateway).ServeHTTP(rec, httptest.NewRequest("GET", "/mock/", nil))
+	if rec.Code != 503 || rec.Header().Get("Retry-After") != sx.NotLoadedRetryAfter {
+		t.Errorf("bad response before loading a configuration: %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	checkError(t, rec.Body.Bytes(), sx.ErrorServiceUnavailable)
+}
+
+func TestGatewayErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set(sx.RequestIDHeader, "upstream")
+		w.Write([]byte(r.Header.Get(sx.RequestIDHeader)))
+	}))
+	defer upstream.Close()
+	// nothing listens on a closed listener address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	config := func(format string) *sx.GatewayConfig {
+		conf := new(sx.GatewayConfig)
+		err := conf.Read(strings.NewReader(fmt.Sprintf(`
+errors:
+  format: %s
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: get
+        method: GET
+        path: /items
+      - name: post
+        method: POST
+        path: /items
+        maxbodybytes: 4
+  - name: down
+    addresses: ["%s"]
+    routes:
+      - name: any
+        path: /*
+`, format, upstream.Listener.Addr(), down)))
+		if err != nil {
+			t.Fatalf("failed reading configuration: %v", err)
+		}
+		return conf
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(config("json")); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	do := func(method, path string, body io.Reader, id string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, gw.URL+path, body)
+		if id != "" {
+			req.Header.Set(sx.RequestIDHeader, id)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, b
+	}
+
+	// request IDs are forwarded upstream and replace the upstream ones
+	res, body := do("GET", "/mock/items", nil, "abc")
+	if res.StatusCode != 200 || string(body) != "abc" || res.Header.Values(sx.RequestIDHeader)[0] != "abc" || len(res.Header.Values(sx.RequestIDHeader)) != 1 {
+		t.Errorf("bad request ID: %d %q %q", res.StatusCode, body, res.Header.Values(sx.RequestIDHeader))
+	}
+	res, body = do("GET", "/mock/items", nil, "")
+	if id := res.Header.Get(sx.RequestIDHeader); id == "" || id != string(body) {
+		t.Errorf("request ID %q not generated and forwarded: %q", id, body)
+	}
+
+	res, body = do("DELETE", "/mock/items", nil, "abc")
+	if res.StatusCode != 405 || res.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("bad method not allowed response: %d %q", res.StatusCode, res.Header.Get("Allow"))
+	}
+	checkError(t, body, sx.ErrorBadMethod)
+
+	res, body = do("POST", "/mock/items", strings.NewReader("data"), "")
+	if res.StatusCode != 200 {
+		t.Errorf("body within the limit rejected: %d %q", res.StatusCode, body)
+	}
+	res, body = do("POST", "/mock/items", strings.NewReader("large"), "")
+	if res.StatusCode != 413 {
+		t.Errorf("large body not rejected: %d", res.StatusCode)
+	}
+	checkError(t, body, sx.ErrorPayloadTooLarge)
+	// without a content length, the body is limited while being proxied
+	res, body = do("POST", "/mock/items", io.MultiReader(strings.NewReader("large")), "")
+	if res.StatusCode != 413 {
+		t.Errorf("large streamed body not rejected: %d", res.StatusCode)
+	}
+	checkError(t, body, sx.ErrorPayloadTooLarge)
+
+	res, body = do("GET", "/down/", nil, "")
+	if res.StatusCode != 502 || res.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("bad upstream failure response: %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	checkError(t, body, sx.ErrorBadGateway)
+
+	if err := g.LoadConfig(config("problem")); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	res, body = do("GET", "/down/", nil, "abc")
+	var p sx.Problem
+	if err := json.Unmarshal(body, &p); err != nil || res.Header.Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("bad problem response: %q %q", res.Header.Get("Content-Type"), body)
+	}
+	expected := sx.Problem{
+		Type:      "about:blank",
+		Title:     "Bad Gateway",
+		Status:    502,
+		Detail:    "bad gateway",
+		Instance:  "/down/",
+		RequestID: "abc",
+	}
+	if p != expected {
+		t.Errorf("bad problem: %+v", p)
 	}
 }
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+)
+
+// outlierState tracks a backend's consecutive failures, ejecting it from
+// load balancing when they cross the service outlier detection thresholds.
+type outlierState struct {
+	ejectedUntil int64 // unix nanoseconds
+
+	mu             sync.Mutex
+	consecutive5xx int
+	consecutiveErr int
+	ejections      int
+}
+
+func (o *outlierState) ok(now time.Time) bool {
+	return now.UnixNano() >= atomic.LoadInt64(&o.ejectedUntil)
+}
+
+// record records the outcome of a proxied request: either a response
+// status or an error. It returns the ejection duration if the backend was
+// just ejected, 0 otherwise.
+func (o *outlierState) record(od *sx.OutlierDetection, status int, err error, now time.Time) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch {
+	case err != nil:
+		o.consecutiveErr++
+	case status >= 500:
+		o.consecutive5xx++
+	default:
+		o.consecutive5xx, o.consecutiveErr = 0, 0
+		return 0
+	}
+	if !o.ok(now) {
+		// requests still completing after the ejection
+		return 0
+	}
+	if o.consecutive5xx < od.Consecutive5xx && o.consecutiveErr < od.ConsecutiveErrors {
+		return 0
+	}
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&o.ejectedUntil))) > od.MaxEjectionTime {
+		o.ejections = 0
+	}
+	o.ejections++
+	d := od.BaseEjectionTime
+	for i := 1; i < o.ejections && d < od.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > od.MaxEjectionTime {
+		d = od.MaxEjectionTime
+	}
+	atomic.StoreInt64(&o.ejectedUntil, now.Add(d).UnixNano())
+	o.consecutive5xx, o.consecutiveErr = 0, 0
+	return d
+}
+
+// observe feeds a proxied request outcome to outlier detection, if the
+// service has it enabled.
+func (bg *backendgroup) observe(b *backend, status int, err error) {
+	od := bg.svc.OutlierDetection
+	if od == nil {
+		return
+	}
+	if d := b.outlier.record(od, status, err, time.Now()); d > 0 {
+		log.Printf("backend %s of service %q ejected for %s", b.url, bg.svc.Name, d)
+		metricBackendEjections.WithLabelValues(bg.svc.Name, b.url.String()).Inc()
+	}
+}
+
+// proxyError records upstream errors for outlier detection, then replies
+// with a 413 if the request body is too large, a 504 if a timeout elapsed
+// and a 502 otherwise.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := r.Context().Value(sxCtxKey).(*sxCtx)
+	kind := timeoutKind(r, err)
+	ctx.clientFault = errors.Is(err, errBodyTooLarge) || kind == "deadline"
+	// the client going away isn't the backend's fault either
+	if r.Context().Err() != context.Canceled && !ctx.clientFault {
+		ctx.group.observe(ctx.backend, 0, err)
+	}
+	log.Printf("http: proxy error: %v", err)
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		writeError(w, r, ctx.state, sx.ErrorPayloadTooLarge)
+	case kind != "":
+		metricRouteTimeouts.WithLabelValues(append(routeLabels(ctx.route.RouteGroup, r.Method), kind)...).Inc()
+		writeError(w, r, ctx.state, sx.ErrorGatewayTimeout)
+	default:
+		writeError(w, r, ctx.state, sx.ErrorBadGateway)
+	}
+}
@@ -0,0 +1,125 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestOutlierStateRecord(t *testing.T) {
+	od := &sx.OutlierDetection{
+		Consecutive5xx:    2,
+		ConsecutiveErrors: 3,
+		BaseEjectionTime:  time.Second,
+		MaxEjectionTime:   3 * time.Second,
+	}
+	o := new(outlierState)
+	now := time.Unix(1000, 0)
+	fail := errors.New("connection refused")
+
+	if d := o.record(od, 500, nil, now); d != 0 {
+		t.Errorf("ejected too early")
+	}
+	if d := o.record(od, 200, nil, now); d != 0 {
+		t.Errorf("ejected on success")
+	}
+	o.record(od, 0, fail, now)
+	o.record(od, 0, fail, now)
+	if d := o.record(od, 0, fail, now); d != time.Second {
+		t.Errorf("bad first ejection: %v", d)
+	}
+	if o.ok(now) || !o.ok(now.Add(time.Second)) {
+		t.Errorf("bad ejection period")
+	}
+
+	// ejections double up to the maximum
+	now = now.Add(time.Second)
+	for _, expected := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		o.record(od, 503, nil, now)
+		d := o.record(od, 503, nil, now)
+		if d != expected {
+			t.Errorf("expected ejection for %v, got %v", expected, d)
+		}
+		now = now.Add(d)
+	}
+
+	// and are reset after staying in rotation for the maximum
+	now = now.Add(od.MaxEjectionTime + time.Second)
+	o.record(od, 500, nil, now)
+	if d := o.record(od, 500, nil, now); d != time.Second {
+		t.Errorf("ejection time not reset: %v", d)
+	}
+}
+
+func TestBackendGroupOutlierDetection(t *testing.T) {
+	var failing int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("bad"))
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("good"))
+	}))
+	defer good.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s", "%s"]
+    outlierdetection:
+      consecutive5xx: 2
+      baseejectiontime: 200ms
+    routes:
+      - name: root
+        path: /*
+`, bad.Listener.Addr(), good.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+	get := func() string {
+		res, err := http.Get(gw.URL + "/mock/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	for i := 0; i < 4; i++ {
+		if body := get(); body != "good" {
+			t.Fatalf("request %d sent to ejected backend", i)
+		}
+	}
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(250 * time.Millisecond)
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[get()] = true
+	}
+	if !seen["bad"] {
+		t.Errorf("backend not back in rotation after ejection")
+	}
+}
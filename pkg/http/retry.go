@@ -0,0 +1,316 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+)
+
+// retryBudgetWindow is the number of seconds the retry budget counts
+// requests and retries over.
+const retryBudgetWindow = 10
+
+// maxRetryBody is the size of the largest request body buffered to be
+// replayed on retries; requests with larger bodies aren't retried.
+const maxRetryBody = 64 << 10
+
+// errHeaderTimeout is returned when the header (or retry per-try) timeout
+// elapses before the upstream response headers.
+var errHeaderTimeout = errors.New("timeout awaiting upstream response headers")
+
+// retryBudget counts requests and retries over the last
+// retryBudgetWindow seconds, allowing retries up to a fraction of the
+// requests. It's shared by all states with the same budget configuration.
+type retryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu       sync.Mutex
+	second   int64
+	requests [retryBudgetWindow]int
+	retries  [retryBudgetWindow]int
+}
+
+// advance clears the counters of the seconds elapsed since the last call,
+// returning the index of the current second.
+func (rb *retryBudget) advance(now time.Time) int {
+	sec := now.Unix()
+	for s := rb.second + 1; s <= sec && s <= rb.second+retryBudgetWindow; s++ {
+		rb.requests[s%retryBudgetWindow] = 0
+		rb.retries[s%retryBudgetWindow] = 0
+	}
+	if sec > rb.second {
+		rb.second = sec
+	}
+	return int(sec % retryBudgetWindow)
+}
+
+// request counts a request.
+func (rb *retryBudget) request(now time.Time) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.requests[rb.advance(now)]++
+}
+
+// retry counts a retry, returning false if the budget is exhausted.
+func (rb *retryBudget) retry(now time.Time) bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	i := rb.advance(now)
+	requests, retries := 0, 0
+	for j := 0; j < retryBudgetWindow; j++ {
+		requests += rb.requests[j]
+		retries += rb.retries[j]
+	}
+	if float64(retries) >= rb.ratio*float64(requests)+float64(rb.minPerSecond*retryBudgetWindow) {
+		return false
+	}
+	rb.retries[i]++
+	return true
+}
+
+// transportFunc adapts a function to http.RoundTripper.
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// roundTrip sends req to the request backend, hedging it if the route
+// has a hedge policy. If the route has a retry policy, failed attempts
+// are retried on the next backends of the group, as long as the gateway
+// retry budget allows it.
+func roundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context().Value(sxCtxKey).(*sxCtx)
+	ctx.state.budget.request(time.Now())
+	timeout := routeTimeout(req.Context()).Header
+	policy, hedge := ctx.route.RouteGroup.Retry, ctx.route.RouteGroup.Hedge
+	retried := policy != nil && policy.RetriesMethod(req.Method)
+	hedged := hedge != nil && hedge.HedgesMethod(req.Method)
+	if !retried && !hedged {
+		return ctx.backend.try(req, timeout)
+	}
+	body, ok, err := bufferBody(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading request body")
+	}
+	if !ok {
+		return ctx.backend.try(req, timeout)
+	}
+	if !retried {
+		return ctx.send(req, body, timeout, hedged)
+	}
+	if policy.PerTryTimeout > 0 && (timeout <= 0 || policy.PerTryTimeout < timeout) {
+		timeout = policy.PerTryTimeout
+	}
+	tried := make([]*backend, 0, policy.Attempts)
+	for attempt := 1; ; attempt++ {
+		b := ctx.backend
+		tried = append(tried, b)
+		res, err := ctx.send(req, body, timeout, hedged)
+		// hedging may have moved the request to another backend
+		cur := ctx.backend
+		if cur != b {
+			tried = append(tried, cur)
+		}
+		if attempt >= policy.Attempts || !retryable(policy, res, err) || req.Context().Err() != nil {
+			return res, err
+		}
+		next := ctx.group.retryBackend(req, tried)
+		if next == nil {
+			return res, err
+		}
+		labels := routeLabels(ctx.route.RouteGroup, req.Method)
+		if !ctx.state.budget.retry(time.Now()) {
+			metricRouteRetryBudgetExhausted.WithLabelValues(labels...).Inc()
+			return res, err
+		}
+		// the failed attempt doesn't reach the proxy hooks
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		ctx.group.observe(cur, status, err)
+		if err != nil {
+			log.Printf("%s %s failed on %s, retrying on %s: %v", req.Method, ctx.originalURL, cur.url.Host, next.url.Host, err)
+		} else {
+			log.Printf("%s %s failed on %s with %d, retrying on %s", req.Method, ctx.originalURL, cur.url.Host, status, next.url.Host)
+		}
+		metricRouteRetries.WithLabelValues(labels...).Inc()
+		if !sleep(req.Context(), backoff(policy, attempt)) {
+			return nil, req.Context().Err()
+		}
+		ctx.switchBackend(next)
+		req = retarget(req, b, next)
+	}
+}
+
+// try sends req to the backend, failing with errHeaderTimeout if the
+// response headers don't arrive within timeout (if positive). The time
+// left before the request deadline, if any, is forwarded to the backend.
+// Failures count as latency samples of at least timeout, unless the
+// request was cancelled or its body was too large.
+func (b *backend) try(req *http.Request, timeout time.Duration) (res *http.Response, err error) {
+	if deadline, ok := req.Context().Deadline(); ok {
+		ctx := req.Context().Value(sxCtxKey).(*sxCtx)
+		req = forwardDeadline(req, ctx.state.conf.Deadline.Header, deadline)
+	}
+	start := time.Now()
+	defer func() {
+		if err != nil && req.Context().Err() == nil && !errors.Is(err, errBodyTooLarge) {
+			b.observeFailure(time.Since(start), timeout)
+		}
+	}()
+	if timeout <= 0 {
+		return b.transport.RoundTrip(req)
+	}
+	tctx, cancel := context.WithCancel(req.Context())
+	var expired int32
+	t := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&expired, 1)
+		cancel()
+	})
+	res, err = b.transport.RoundTrip(req.WithContext(tctx))
+	if !t.Stop() && atomic.LoadInt32(&expired) == 1 {
+		if res != nil {
+			res.Body.Close()
+		}
+		cancel()
+		return nil, errHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the body is still streamed with the attempt context
+	res.Body = &cancelBody{res.Body, cancel}
+	return res, nil
+}
+
+// cancelBody cancels its request context once closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+// retryable reports whether the outcome of an attempt is retried by the
+// policy.
+func retryable(policy *sx.Retry, res *http.Response, err error) bool {
+	var op *net.OpError
+	switch {
+	case err == errHeaderTimeout:
+		return policy.RetriesOn(sx.RetryOnTimeout)
+	case errors.As(err, &op) && op.Op == "dial":
+		return policy.RetriesOn(sx.RetryOnConnectError)
+	case err != nil:
+		// the request may have been processed
+		return false
+	}
+	return policy.RetriesOn(strconv.Itoa(res.StatusCode))
+}
+
+// bufferBody reads the body of req so that it can be replayed, unless it's
+// larger than maxRetryBody, in which case ok is false and req gets its
+// body back unread. A nil body means req has none.
+func bufferBody(req *http.Request) (body []byte, ok bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > maxRetryBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return body, true, nil
+}
+
+// backoff returns a random delay before retrying after attempt, between 0
+// and the policy backoff doubled on each attempt.
+func backoff(policy *sx.Retry, attempt int) time.Duration {
+	d := policy.Backoff
+	for i := 1; i < attempt && d < policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > policy.MaxBackoff {
+		d = policy.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// retryBackend returns the backend to retry r on, preferring available
+// backends that weren't tried yet.
+func (bg *backendgroup) retryBackend(r *http.Request, tried []*backend) *backend {
+	now := time.Now()
+	untried := func(b *backend) bool {
+		for _, t := range tried {
+			if t == b {
+				return false
+			}
+		}
+		return true
+	}
+	if b := bg.balancer.pick(r, bg.backends, func(b *backend) bool { return untried(b) && b.available(now) }); b != nil {
+		return b
+	}
+	if b := bg.balancer.pick(r, bg.backends, untried); b != nil {
+		return b
+	}
+	return bg.next(r)
+}
+
+// retarget returns a copy of req, sent to from, to be sent to instead.
+func retarget(req *http.Request, from, to *backend) *http.Request {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = to.url.Scheme
+	r.URL.Host = to.url.Host
+	r.Host = to.url.Host
+	if from.url.Path != to.url.Path {
+		path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(from.url.Path, "/"))
+		r.URL.Path = strings.TrimSuffix(to.url.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+		r.URL.RawPath = ""
+	}
+	return r
+}
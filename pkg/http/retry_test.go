@@ -0,0 +1,187 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rb := &retryBudget{ratio: 0.5}
+	for i := 0; i < 4; i++ {
+		rb.request(now)
+	}
+	if !rb.retry(now) || !rb.retry(now.Add(time.Second)) {
+		t.Errorf("retries within the budget denied")
+	}
+	if rb.retry(now.Add(time.Second)) {
+		t.Errorf("retry over the budget allowed")
+	}
+	// requests and retries expire after the window
+	later := now.Add((retryBudgetWindow + 1) * time.Second)
+	rb.request(later)
+	rb.request(later)
+	if !rb.retry(later) {
+		t.Errorf("retry denied after the window")
+	}
+
+	rb = &retryBudget{minPerSecond: 1}
+	for i := 0; i < retryBudgetWindow; i++ {
+		if !rb.retry(now) {
+			t.Fatalf("minimum retries denied")
+		}
+	}
+	if rb.retry(now) {
+		t.Errorf("retry over the minimum allowed")
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	mustparse := func(s string) *backend {
+		u, err := parseURL(s)
+		if err != nil {
+			panic(err)
+		}
+		return &backend{url: u}
+	}
+	req := httptest.NewRequest("GET", "http://a:8080/api/users?x=1", nil)
+	for _, c := range []struct {
+		from, to, expected string
+	}{
+		{"a:8080", "b:8080", "http://b:8080/api/users?x=1"},
+		{"http://a:8080/api", "http://b:8080/v2/", "http://b:8080/v2/users?x=1"},
+		{"http://a:8080/", "https://b", "https://b/api/users?x=1"},
+	} {
+		r := retarget(req, mustparse(c.from), mustparse(c.to))
+		if r.URL.String() != c.expected || r.Host != r.URL.Host {
+			t.Errorf("bad retargeted url from %s to %s: %s (host %s)", c.from, c.to, r.URL, r.Host)
+		}
+	}
+}
+
+func TestGatewayRetry(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok " + string(body)))
+	}))
+	defer ok.Close()
+	// nothing listens on a closed listener address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	conf := new(sx.GatewayConfig)
+	err = conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s", "%s", "%s"]
+    routes:
+      - name: root
+        retry:
+          attempts: 3
+          backoff: 1ms
+          maxbackoff: 1ms
+        routes:
+          - name: any
+            path: /*
+`, failing.Listener.Addr(), down, ok.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	do := func(method, body string) (int, string) {
+		req, _ := http.NewRequest(method, gw.URL+"/mock/", strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	for i := 0; i < 6; i++ {
+		if status, body := do("PUT", "data"); status != http.StatusOK || body != "ok data" {
+			t.Errorf("request %d not retried: %d %q", i, status, body)
+		}
+	}
+	// non-idempotent requests aren't retried
+	failed := 0
+	for i := 0; i < 6; i++ {
+		if status, _ := do("POST", "data"); status != http.StatusOK {
+			failed++
+		}
+	}
+	if failed != 4 {
+		t.Errorf("expected 4 failed POST requests, got %d", failed)
+	}
+}
+
+func TestGatewayRetryTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	// the per-try timeout only applies until the response headers
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(" streamed"))
+	}))
+	defer streaming.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s", "%s"]
+    routes:
+      - name: root
+        path: /*
+        retry:
+          on: [timeout]
+          pertrytimeout: 50ms
+`, slow.Listener.Addr(), streaming.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(gw.URL + "/mock/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "ok streamed" {
+			t.Errorf("request %d: bad response: %d %q", i, res.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"math/rand"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// warmth returns the fraction of its traffic share the backend should
+// get while slow starting over window: from 0 when it was added or
+// recovered (from failed health checks or an ejection), to 1 once window
+// has passed.
+func (b *backend) warmth(now time.Time, window time.Duration) float64 {
+	if window <= 0 {
+		return 1
+	}
+	since := atomic.LoadInt64(&b.warmSince)
+	if ejectedUntil := atomic.LoadInt64(&b.outlier.ejectedUntil); ejectedUntil > since {
+		since = ejectedUntil
+	}
+	if since == 0 {
+		return 1
+	}
+	elapsed := now.Sub(time.Unix(0, since))
+	if elapsed >= window {
+		return 1
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(window)
+}
+
+// admit randomly accepts the backend for a request with a probability
+// equal to its warmth.
+func (b *backend) admit(now time.Time, window time.Duration) bool {
+	w := b.warmth(now, window)
+	return w >= 1 || rand.Float64() < w
+}
+
+// recovered starts slow starting the backend.
+func (b *backend) recovered(now time.Time) {
+	atomic.StoreInt64(&b.warmSince, now.UnixNano())
+}
+
+// has reports whether the group has a backend at u.
+func (bg *backendgroup) has(u *url.URL) bool {
+	for _, b := range bg.backends {
+		if b.url.String() == u.String() {
+			return true
+		}
+	}
+	return false
+}
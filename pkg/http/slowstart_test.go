@@ -0,0 +1,90 @@
+package http
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestBackendWarmth(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := new(backend)
+	if w := b.warmth(now, time.Minute); w != 1 {
+		t.Errorf("backend never slow started should be warm, is %v", w)
+	}
+	b.recovered(now)
+	for _, c := range []struct {
+		elapsed time.Duration
+		warmth  float64
+	}{
+		{0, 0},
+		{15 * time.Second, 0.25},
+		{30 * time.Second, 0.5},
+		{time.Minute, 1},
+		{time.Hour, 1},
+	} {
+		if w := b.warmth(now.Add(c.elapsed), time.Minute); w != c.warmth {
+			t.Errorf("warmth after %v: expected %v, got %v", c.elapsed, c.warmth, w)
+		}
+	}
+	if w := b.warmth(now, 0); w != 1 {
+		t.Errorf("backend should be warm without slow start, is %v", w)
+	}
+	// slow start again after an ejection
+	atomic.StoreInt64(&b.outlier.ejectedUntil, now.Add(time.Hour).UnixNano())
+	if w := b.warmth(now.Add(time.Hour+30*time.Second), time.Minute); w != 0.5 {
+		t.Errorf("warmth after ejection: expected 0.5, got %v", w)
+	}
+}
+
+func TestReloadSlowStartsNewBackends(t *testing.T) {
+	read := func(addrs string) *sx.GatewayConfig {
+		conf := new(sx.GatewayConfig)
+		err := conf.Read(strings.NewReader(`
+services:
+  - name: a
+    addresses: [` + addrs + `]
+    slowstart: 1h
+    routes:
+      - name: root
+        path: /
+`))
+		if err != nil {
+			t.Fatalf("failed reading configuration: %v", err)
+		}
+		return conf
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(read("localhost:8080")); err != nil {
+		t.Fatal(err)
+	}
+	// no slow start on startup
+	now := time.Now()
+	if b := g.current().serviceBackends["a"].backends[0]; b.warmth(now, time.Hour) != 1 {
+		t.Errorf("backend slow starting on startup")
+	}
+	if err := g.LoadConfig(read("localhost:8080, localhost:8081")); err != nil {
+		t.Fatal(err)
+	}
+	bg := g.current().serviceBackends["a"]
+	old, added := bg.backends[0], bg.backends[1]
+	if old.warmth(now, time.Hour) != 1 {
+		t.Errorf("existing backend slow starting after reload")
+	}
+	if added.warmth(time.Now(), time.Hour) > 0.01 {
+		t.Errorf("added backend not slow starting after reload")
+	}
+	for i := 0; i < 100; i++ {
+		if bg.next(nil) != old {
+			t.Fatalf("cold backend picked")
+		}
+	}
+	// a cold backend still serves if it's the only available one
+	old.health.down = 1
+	if bg.next(nil) != added {
+		t.Errorf("cold backend not picked when it's the only available one")
+	}
+}
@@ -0,0 +1,190 @@
+package http
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+	"github.com/trapped/sx/pkg/lifecycle"
+	"github.com/trapped/sx/pkg/memory"
+	"github.com/trapped/sx/pkg/redis"
+)
+
+// state is an immutable snapshot of the gateway runtime configuration.
+// Requests keep using the state they started with, even if a new one is
+// loaded in the meantime.
+//
+// Resources (stores and backend groups) are shared across states when
+// their configuration doesn't change, and closed once the last state
+// using them is drained.
+type state struct {
+	conf            *sx.GatewayConfig
+	routes          []sx.Route
+	serviceBackends map[string]*backendgroup
+	store           *store
+	budget          *retryBudget
+	hedges          map[*sx.RouteGroup]*hedgeDelay
+	gen             *lifecycle.Generation
+}
+
+// store is a reference-counted sx.Store, along with the configuration
+// used to create it.
+type store struct {
+	sx.Store
+	*lifecycle.Ref
+	redisConf  sx.Redis
+	memoryConf sx.Memory
+}
+
+func newStore(conf *sx.GatewayConfig) *store {
+	s := &store{redisConf: conf.Redis, memoryConf: conf.Memory}
+	if conf.Redis.Configured() {
+		c := redis.NewClient(conf.Redis)
+		s.Store = c
+		s.Ref = lifecycle.NewRef(func() {
+			if err := c.Close(); err != nil {
+				log.Printf("error closing redis client: %v", err)
+			}
+		})
+	} else {
+		s.Store = memory.NewStore(conf.Memory)
+		s.Ref = lifecycle.NewRef(nil)
+	}
+	return s
+}
+
+func (s *store) reusable(conf *sx.GatewayConfig) bool {
+	if conf.Redis.Configured() {
+		return reflect.DeepEqual(s.redisConf, conf.Redis)
+	}
+	_, ok := s.Store.(*memory.Store)
+	return ok && s.memoryConf == conf.Memory
+}
+
+// match returns the first route matching method and path. If routes
+// match path but not method, it returns the methods they allow instead.
+func (st *state) match(method, path string) (rt *sx.Route, allowed []string) {
+	for i := 0; i < len(st.routes); i++ {
+		r := &st.routes[i]
+		if !r.Match(path) {
+			continue
+		}
+		if r.MatchMethod(method) {
+			return r, nil
+		}
+		if !contains(allowed, r.RouteGroup.Method) {
+			allowed = append(allowed, r.RouteGroup.Method)
+		}
+	}
+	return nil, allowed
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// close releases the state resources.
+func (st *state) close() {
+	for _, bg := range st.serviceBackends {
+		bg.Release()
+	}
+	if st.store != nil {
+		st.store.Release()
+	}
+}
+
+// newState builds a new state from conf, reusing the resources of prev
+// (the currently loaded state, if any) when possible.
+func newState(g *Gateway, prev *state, conf *sx.GatewayConfig) (*state, error) {
+	st := &state{
+		conf:            conf,
+		routes:          make([]sx.Route, 0),
+		serviceBackends: make(map[string]*backendgroup),
+		hedges:          make(map[*sx.RouteGroup]*hedgeDelay),
+	}
+	st.gen = lifecycle.NewGeneration(st.close)
+	for i := 0; i < len(conf.Services); i++ {
+		svc := conf.Services[i]
+		if bg, ok := prev.backendGroup(svc); ok {
+			bg.Acquire()
+			st.serviceBackends[svc.Name] = bg
+		} else if bg, err := newBackendGroup(g, svc, prev.previousGroup(svc)); err != nil {
+			st.close()
+			return nil, errors.Wrapf(err, "error building backends for service %q", svc.Name)
+		} else {
+			st.serviceBackends[svc.Name] = bg
+		}
+		svcRoutes, err := svc.CompileRoutes()
+		if err != nil {
+			st.close()
+			return nil, errors.Wrapf(err, "error compiling routes for service %q", svc.Name)
+		}
+		for _, rt := range svcRoutes {
+			if h := rt.RouteGroup.Hedge; h != nil && h.Percentile > 0 {
+				latencies := prev.routeLatencies(rt.RouteGroup)
+				if latencies == nil {
+					latencies = newRouteLatencies(time.Now())
+				}
+				st.hedges[rt.RouteGroup] = &hedgeDelay{rg: rt.RouteGroup, latencies: latencies}
+			}
+		}
+		st.routes = append(st.routes, svcRoutes...)
+	}
+	if prev != nil && prev.store.reusable(conf) {
+		prev.store.Acquire()
+		st.store = prev.store
+	} else {
+		st.store = newStore(conf)
+	}
+	ratio, minPerSecond := *conf.RetryBudget.Ratio, *conf.RetryBudget.MinPerSecond
+	if prev != nil && prev.budget.ratio == ratio && prev.budget.minPerSecond == minPerSecond {
+		st.budget = prev.budget
+	} else {
+		st.budget = &retryBudget{ratio: ratio, minPerSecond: minPerSecond}
+	}
+	return st, nil
+}
+
+// retireRemovedBackends retires the backends of st that next doesn't use.
+func (st *state) retireRemovedBackends(next *state) {
+	used := make(map[*backend]bool)
+	for _, bg := range next.serviceBackends {
+		for _, b := range bg.backends {
+			used[b] = true
+		}
+	}
+	for _, bg := range st.serviceBackends {
+		for _, b := range bg.backends {
+			if !used[b] {
+				b.retire()
+			}
+		}
+	}
+}
+
+// previousGroup returns the backend group svc had in st, if any.
+func (st *state) previousGroup(svc *sx.Service) *backendgroup {
+	if st == nil {
+		return nil
+	}
+	return st.serviceBackends[svc.Name]
+}
+
+// backendGroup returns the backend group of svc if it can be reused.
+func (st *state) backendGroup(svc *sx.Service) (*backendgroup, bool) {
+	if st == nil {
+		return nil, false
+	}
+	bg, ok := st.serviceBackends[svc.Name]
+	if !ok || !bg.svc.SameBackends(svc) {
+		return nil, false
+	}
+	return bg, true
+}
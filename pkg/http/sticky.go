@@ -0,0 +1,80 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+// sticky pins clients to backends with signed cookies. Cookies name
+// backends by an ID derived from their URL, so they stay valid across
+// reloads that keep the backend.
+type sticky struct {
+	conf *sx.Sticky
+	path string
+	byID map[string]*backend
+}
+
+func newSticky(svc *sx.Service, backends []*backend) *sticky {
+	s := &sticky{
+		conf: svc.Sticky,
+		path: svc.PathPrefix,
+		byID: make(map[string]*backend, len(backends)),
+	}
+	for _, b := range backends {
+		s.byID[stickyID(b)] = b
+	}
+	return s
+}
+
+func stickyID(b *backend) string {
+	return strconv.FormatUint(hashKey(b.url.String()), 36)
+}
+
+func (s *sticky) sign(id string) string {
+	mac := hmac.New(sha256.New, []byte(s.conf.Secret))
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// backend returns the backend named by the request cookie, if the cookie
+// is valid and the backend available.
+func (s *sticky) backend(r *http.Request, now time.Time) *backend {
+	c, err := r.Cookie(s.conf.Cookie)
+	if err != nil {
+		return nil
+	}
+	i := strings.IndexByte(c.Value, '.')
+	if i < 0 {
+		return nil
+	}
+	id, sig := c.Value[:i], c.Value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.sign(id))) {
+		return nil
+	}
+	b := s.byID[id]
+	if b == nil || !b.available(now) {
+		return nil
+	}
+	return b
+}
+
+// setCookie pins the client to b.
+func (s *sticky) setCookie(w http.ResponseWriter, r *http.Request, b *backend) {
+	id := stickyID(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.conf.Cookie,
+		Value:    id + "." + s.sign(id),
+		Path:     s.path,
+		MaxAge:   int(s.conf.TTL.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,100 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/trapped/sx"
+)
+
+func TestGatewaySticky(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprint(i)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer s.Close()
+		addrs = append(addrs, fmt.Sprintf("%q", s.Listener.Addr()))
+	}
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: [%s]
+    sticky:
+      secret: s3cr3t
+      ttl: 1h
+    routes:
+      - name: root
+        path: /*
+`, strings.Join(addrs, ", "))))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	get := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req, _ := http.NewRequest("GET", gw.URL+"/mock/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		for _, c := range res.Cookies() {
+			if c.Name == sx.DefaultStickyCookie {
+				return string(body), c
+			}
+		}
+		return string(body), nil
+	}
+
+	first, cookie := get(nil)
+	if cookie == nil {
+		t.Fatalf("no sticky cookie issued")
+	}
+	if cookie.Path != "/mock" || !cookie.HttpOnly || cookie.MaxAge != 3600 {
+		t.Errorf("bad cookie attributes: %+v", cookie)
+	}
+	for i := 0; i < 5; i++ {
+		body, c := get(cookie)
+		if body != first {
+			t.Fatalf("request not pinned: got backend %s, expected %s", body, first)
+		}
+		if c != nil {
+			t.Errorf("cookie reissued for a pinned request")
+		}
+	}
+
+	// tampered cookies are ignored
+	tampered := *cookie
+	tampered.Value = strings.Replace(tampered.Value, ".", "x.", 1)
+	if _, c := get(&tampered); c == nil {
+		t.Errorf("tampered cookie accepted")
+	}
+
+	// unavailable backends lose their clients
+	bg := g.current().serviceBackends["mock"]
+	for _, b := range bg.backends {
+		if stickyID(b)+"."+bg.sticky.sign(stickyID(b)) == cookie.Value {
+			b.health.down = 1
+		}
+	}
+	body, c := get(cookie)
+	if body == first || c == nil {
+		t.Errorf("request pinned to an unavailable backend")
+	}
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+)
+
+// defaultTimeout applies to routes without timeouts.
+var defaultTimeout = sx.Timeout{Connect: sx.DefaultTimeoutConnect, Header: sx.DefaultTimeoutHeader}
+
+// routeTimeout returns the timeouts of the route of the request with
+// context ctx, if any.
+func routeTimeout(ctx context.Context) sx.Timeout {
+	if c, ok := ctx.Value(sxCtxKey).(*sxCtx); ok && c.route.RouteGroup.Timeout != nil {
+		return *c.route.RouteGroup.Timeout
+	}
+	return defaultTimeout
+}
+
+// timeoutKind returns which timeout made the upstream request r fail with
+// err: connect, header, total or deadline (set by the client). It returns
+// an empty string if err isn't caused by a timeout.
+func timeoutKind(r *http.Request, err error) string {
+	var op *net.OpError
+	switch {
+	case r.Context().Err() == context.DeadlineExceeded:
+		if r.Context().Value(sxCtxKey).(*sxCtx).clientDeadline {
+			return "deadline"
+		}
+		return "total"
+	case err == errHeaderTimeout:
+		return "header"
+	case errors.As(err, &op) && op.Op == "dial" && op.Timeout():
+		return "connect"
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestGatewayTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	conf := new(sx.GatewayConfig)
+	err := conf.Read(strings.NewReader(fmt.Sprintf(`
+services:
+  - name: mock
+    addresses: ["%s"]
+    routes:
+      - name: header
+        path: /header
+        timeout:
+          header: 50ms
+      - name: total
+        path: /total
+        timeout:
+          total: 50ms
+`, upstream.Listener.Addr())))
+	if err != nil {
+		t.Fatalf("failed reading configuration: %v", err)
+	}
+	g := new(Gateway)
+	if err := g.LoadConfig(conf); err != nil {
+		t.Fatalf("failed loading configuration: %v", err)
+	}
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	for _, path := range []string{"/mock/header", "/mock/total"} {
+		start := time.Now()
+		res, err := http.Get(gw.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("%s: bad status code: %d", path, res.StatusCode)
+		}
+		checkError(t, body, sx.ErrorGatewayTimeout)
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("%s: timed out after %s", path, d)
+		}
+	}
+}
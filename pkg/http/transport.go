@@ -1,13 +1,27 @@
 package http
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"runtime"
+	"time"
 )
 
 func newTransport() *http.Transport {
 	return &http.Transport{
-		MaxIdleConns:        1000 * runtime.NumCPU(),
-		MaxIdleConnsPerHost: 1000 * runtime.NumCPU(),
+		DialContext:           dialContext,
+		MaxIdleConns:          1000 * runtime.NumCPU(),
+		MaxIdleConnsPerHost:   1000 * runtime.NumCPU(),
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
 	}
 }
+
+// dialContext dials addr within the connect timeout of the route being
+// proxied.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: routeTimeout(ctx).Connect, KeepAlive: 30 * time.Second}
+	return d.DialContext(ctx, network, addr)
+}
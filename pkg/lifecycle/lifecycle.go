@@ -0,0 +1,90 @@
+// package lifecycle tracks the usage of shared resources, closing them
+// once they are no longer used.
+package lifecycle
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Ref is a reference-counted resource: it starts with one reference, and
+// is closed when the last one is released.
+type Ref struct {
+	n     int32
+	close func()
+}
+
+// NewRef returns a Ref holding one reference, calling close once all
+// references are released.
+func NewRef(close func()) *Ref {
+	return &Ref{n: 1, close: close}
+}
+
+// Acquire adds a reference.
+func (r *Ref) Acquire() {
+	atomic.AddInt32(&r.n, 1)
+}
+
+// Release drops a reference, closing the resource if it was the last one.
+func (r *Ref) Release() {
+	if atomic.AddInt32(&r.n, -1) == 0 && r.close != nil {
+		r.close()
+	}
+}
+
+// Closed reports whether all references were released.
+func (r *Ref) Closed() bool {
+	return atomic.LoadInt32(&r.n) <= 0
+}
+
+// Generation tracks the in-flight users of a configuration generation.
+// Once retired, it is closed as soon as it has no users left.
+//
+// Users must check the generation is still current after Acquire, and
+// Release it otherwise: a retired generation may already be closed.
+type Generation struct {
+	inflight int64
+	retired  int32
+	once     sync.Once
+	close    func()
+}
+
+// NewGeneration returns a Generation calling close once it was retired
+// and all of its users were released.
+func NewGeneration(close func()) *Generation {
+	return &Generation{close: close}
+}
+
+// Acquire adds an in-flight user.
+func (g *Generation) Acquire() {
+	atomic.AddInt64(&g.inflight, 1)
+}
+
+// Release removes an in-flight user.
+func (g *Generation) Release() {
+	if atomic.AddInt64(&g.inflight, -1) == 0 && atomic.LoadInt32(&g.retired) == 1 {
+		g.Close()
+	}
+}
+
+// Retire marks the generation as replaced, closing it if unused.
+func (g *Generation) Retire() {
+	atomic.StoreInt32(&g.retired, 1)
+	if atomic.LoadInt64(&g.inflight) == 0 {
+		g.Close()
+	}
+}
+
+// Close closes the generation right away, at most once.
+func (g *Generation) Close() {
+	g.once.Do(func() {
+		if g.close != nil {
+			g.close()
+		}
+	})
+}
+
+// Inflight returns the number of in-flight users.
+func (g *Generation) Inflight() int64 {
+	return atomic.LoadInt64(&g.inflight)
+}
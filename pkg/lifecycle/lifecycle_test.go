@@ -0,0 +1,65 @@
+package lifecycle
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRef(t *testing.T) {
+	closed := 0
+	r := NewRef(func() { closed++ })
+	r.Acquire()
+	r.Release()
+	if closed != 0 || r.Closed() {
+		t.Fatalf("ref closed too early")
+	}
+	r.Release()
+	if closed != 1 || !r.Closed() {
+		t.Fatalf("ref not closed")
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	closed := 0
+	g := NewGeneration(func() { closed++ })
+	g.Acquire()
+	g.Retire()
+	if closed != 0 {
+		t.Fatalf("generation closed with in-flight users")
+	}
+	g.Release()
+	if closed != 1 {
+		t.Fatalf("generation not closed after draining")
+	}
+	g.Acquire()
+	g.Release()
+	if closed != 1 {
+		t.Fatalf("generation closed more than once")
+	}
+}
+
+func TestGenerationConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	closed := 0
+	g := NewGeneration(func() {
+		mu.Lock()
+		closed++
+		mu.Unlock()
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				g.Acquire()
+				g.Release()
+			}
+		}()
+	}
+	g.Retire()
+	wg.Wait()
+	if closed != 1 {
+		t.Fatalf("generation closed %d times", closed)
+	}
+}
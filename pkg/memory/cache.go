@@ -0,0 +1,76 @@
+package memory
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// cacheShard is a size-bounded LRU cache with per-entry expiration.
+type cacheShard struct {
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	lru      *list.List
+	size     int64
+	capacity int64
+}
+
+func (c *cacheShard) init(capacity int64) {
+	c.items = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.capacity = capacity
+}
+
+func (c *cacheShard) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.size -= e.size()
+}
+
+func (c *cacheShard) get(k string, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+// set stores v under k, unless a live entry already exists, evicting
+// the least recently used entries to make room.
+func (c *cacheShard) set(k string, v []byte, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[k]; ok {
+		if time.Now().Before(el.Value.(*cacheEntry).expires) {
+			return
+		}
+		c.remove(el)
+	}
+	e := &cacheEntry{k, v, expires}
+	if e.size() > c.capacity {
+		return
+	}
+	for c.size+e.size() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	c.items[k] = c.lru.PushFront(e)
+	c.size += e.size()
+}
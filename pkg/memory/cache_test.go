@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestCacheShardEviction(t *testing.T) {
+	c := new(cacheShard)
+	c.init(10)
+	now := time.Now()
+	c.set("a", []byte("1234"), now.Add(time.Minute))
+	c.set("b", []byte("1234"), now.Add(time.Minute))
+	// touch a so b is the least recently used
+	if _, ok := c.get("a", now); !ok {
+		t.Fatalf("a should be cached")
+	}
+	c.set("c", []byte("1234"), now.Add(time.Minute))
+	if _, ok := c.get("b", now); ok {
+		t.Errorf("b should have been evicted")
+	}
+	if _, ok := c.get("a", now); !ok {
+		t.Errorf("a should still be cached")
+	}
+	if _, ok := c.get("c", now.Add(2*time.Minute)); ok {
+		t.Errorf("c should have expired")
+	}
+	c.set("d", []byte("way too large"), now.Add(time.Minute))
+	if _, ok := c.get("d", now); ok {
+		t.Errorf("d should not fit")
+	}
+	if c.size != 5 {
+		t.Errorf("bad cache size: %d", c.size)
+	}
+}
+
+func TestStoreResponse(t *testing.T) {
+	s := NewStore(sx.Memory{CacheBytes: sx.DefaultMemoryCacheBytes})
+	ctx := context.Background()
+	k := s.MakeKey("resp", "/test", nil)
+	resp := &http.Response{
+		StatusCode: 200,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"X-Test": []string{"yes"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString("Hello world!")),
+	}
+	s.SetResponse(ctx, k, resp, time.Minute)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "Hello world!" {
+		t.Errorf("response body not restored: %q", body)
+	}
+	cached, ok := s.GetResponse(ctx, k)
+	if !ok {
+		t.Fatalf("response should be cached")
+	}
+	body, _ := ioutil.ReadAll(cached.Body)
+	if cached.StatusCode != 200 || cached.Header.Get("X-Test") != "yes" || string(body) != "Hello world!" {
+		t.Errorf("bad cached response: %v %v %q", cached.StatusCode, cached.Header, body)
+	}
+}
@@ -0,0 +1,94 @@
+// package memory provides an in-process cache and rate limit backend
+// implementation, for deployments without Redis.
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+const shardCount = 16
+
+// Store keeps cached responses and rate limit state in memory, local to
+// this process.
+type Store struct {
+	cache  [shardCount]cacheShard
+	limits [shardCount]limitShard
+}
+
+func shardIndex(k string) int {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return int(h.Sum32() % shardCount)
+}
+
+// MakeKey joins the provided mode, url and keys into a single cache key string.
+func (s *Store) MakeKey(mode, url string, keys []string) string {
+	return strings.Join(append([]string{"sx", mode, url}, keys...), ":")
+}
+
+// GetResponse fetches a previously cached HTTP response.
+func (s *Store) GetResponse(ctx context.Context, k string) (resp *http.Response, ok bool) {
+	res, ok := s.cache[shardIndex(k)].get(k, time.Now())
+	if !ok {
+		return nil, false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(res)), nil)
+	return resp, err == nil
+}
+
+// SetResponse stores an HTTP response with the provided TTL, unless one
+// is already cached for the same key.
+func (s *Store) SetResponse(ctx context.Context, k string, resp *http.Response, ttl time.Duration) {
+	// backup body
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("error reading response body: %v", err)
+		return
+	}
+	if resp.ContentLength <= 0 {
+		resp.ContentLength = int64(len(body))
+	}
+	r := bytes.NewReader(body)
+	// restore body
+	resp.Body = io.NopCloser(r)
+	// serialize response
+	buf := bytes.NewBuffer(nil)
+	err = resp.Write(buf)
+	if err != nil {
+		log.Printf("error writing response to cache buffer: %v", err)
+		return
+	}
+	s.cache[shardIndex(k)].set(k, buf.Bytes(), time.Now().Add(ttl))
+	r.Seek(0, io.SeekStart)
+}
+
+// RateLimit counts a request against every window for key k using the
+// given algorithm, and returns the most restrictive result.
+// The request is only counted if all windows allow it.
+func (s *Store) RateLimit(ctx context.Context, k, algorithm string, windows []sx.RateLimitWindow, now time.Time) (sx.RateLimitResult, error) {
+	return s.limits[shardIndex(k)].rateLimit(k, algorithm, windows, now)
+}
+
+// NewStore initializes an in-memory store according to the specified
+// configuration.
+func NewStore(conf sx.Memory) *Store {
+	s := new(Store)
+	for i := range s.cache {
+		s.cache[i].init(conf.CacheBytes / shardCount)
+	}
+	for i := range s.limits {
+		s.limits[i].init()
+	}
+	return s
+}
@@ -0,0 +1,227 @@
+package memory
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+)
+
+// sweepInterval is how often expired rate limit state is removed.
+const sweepInterval = time.Minute
+
+// windowState is the state of a single rate limit window. Algorithms
+// mirror the Redis scripts in pkg/redis.
+type windowState struct {
+	period int64     // index of the current period (fixed and sliding windows)
+	count  float64   // requests in the current period, or tokens left
+	prev   float64   // requests in the previous period
+	ts     time.Time // last refill, or theoretical arrival time
+}
+
+type limitEntry struct {
+	windows map[time.Duration]*windowState
+	expires time.Time
+}
+
+type limitShard struct {
+	mu        sync.Mutex
+	entries   map[string]*limitEntry
+	lastSweep time.Time
+}
+
+func (l *limitShard) init() {
+	l.entries = make(map[string]*limitEntry)
+}
+
+func (l *limitShard) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	for k, e := range l.entries {
+		if now.After(e.expires) {
+			delete(l.entries, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// algorithm implements a rate limit algorithm over a single window.
+type algorithm struct {
+	// refresh brings st up to date and reports whether one more request
+	// would be allowed.
+	refresh func(w sx.RateLimitWindow, st *windowState, now time.Time) bool
+	// take counts a request.
+	take func(w sx.RateLimitWindow, st *windowState, now time.Time)
+	// result reports the window state.
+	result func(w sx.RateLimitWindow, st *windowState, now time.Time, allowed bool) sx.RateLimitResult
+}
+
+func elapsed(w sx.RateLimitWindow, now time.Time) time.Duration {
+	return time.Duration(now.UnixNano() % int64(w.Period))
+}
+
+var algorithms = map[string]algorithm{
+	sx.RateLimitFixedWindow: {
+		refresh: func(w sx.RateLimitWindow, st *windowState, now time.Time) bool {
+			if p := now.UnixNano() / int64(w.Period); p != st.period {
+				st.period, st.count = p, 0
+			}
+			return st.count < float64(w.Limit)
+		},
+		take: func(w sx.RateLimitWindow, st *windowState, now time.Time) {
+			st.count++
+		},
+		result: func(w sx.RateLimitWindow, st *windowState, now time.Time, allowed bool) sx.RateLimitResult {
+			return sx.RateLimitResult{
+				Allowed:   allowed,
+				Limit:     w.Limit,
+				Remaining: w.Limit - int(st.count),
+				Reset:     w.Period - elapsed(w, now),
+			}
+		},
+	},
+	sx.RateLimitSlidingWindow: {
+		refresh: func(w sx.RateLimitWindow, st *windowState, now time.Time) bool {
+			switch p := now.UnixNano() / int64(w.Period); p {
+			case st.period:
+			case st.period + 1:
+				st.period, st.prev, st.count = p, st.count, 0
+			default:
+				st.period, st.prev, st.count = p, 0, 0
+			}
+			return slidingEstimate(w, st, now)+1 <= float64(w.Limit)
+		},
+		take: func(w sx.RateLimitWindow, st *windowState, now time.Time) {
+			st.count++
+		},
+		result: func(w sx.RateLimitWindow, st *windowState, now time.Time, allowed bool) sx.RateLimitResult {
+			est, limit, period := slidingEstimate(w, st, now), float64(w.Limit), float64(w.Period)
+			reset := period - float64(elapsed(w, now))
+			if !allowed {
+				if st.prev > 0 && st.count+1 <= limit {
+					// the previous window fades out enough during this one
+					reset = (est + 1 - limit) * period / st.prev
+				} else {
+					// wait for this window to become the previous one
+					reset += math.Max(0, 1-(limit-1)/st.count) * period
+				}
+			}
+			return sx.RateLimitResult{
+				Allowed:   allowed,
+				Limit:     w.Limit,
+				Remaining: int(math.Floor(limit - est)),
+				Reset:     time.Duration(math.Ceil(reset)),
+			}
+		},
+	},
+	sx.RateLimitTokenBucket: {
+		refresh: func(w sx.RateLimitWindow, st *windowState, now time.Time) bool {
+			if st.ts.IsZero() {
+				st.count, st.ts = float64(w.Burst), now
+			}
+			refill := float64(now.Sub(st.ts)) * float64(w.Limit) / float64(w.Period)
+			st.count, st.ts = math.Min(float64(w.Burst), st.count+math.Max(0, refill)), now
+			return st.count >= 1
+		},
+		take: func(w sx.RateLimitWindow, st *windowState, now time.Time) {
+			st.count--
+		},
+		result: func(w sx.RateLimitWindow, st *windowState, now time.Time, allowed bool) sx.RateLimitResult {
+			rate := float64(w.Limit) / float64(w.Period)
+			reset := (float64(w.Burst) - st.count) / rate
+			if !allowed {
+				reset = (1 - st.count) / rate
+			}
+			return sx.RateLimitResult{
+				Allowed:   allowed,
+				Limit:     w.Limit,
+				Remaining: int(math.Floor(st.count)),
+				Reset:     time.Duration(math.Ceil(reset)),
+			}
+		},
+	},
+	sx.RateLimitGCRA: {
+		refresh: func(w sx.RateLimitWindow, st *windowState, now time.Time) bool {
+			if st.ts.Before(now) {
+				st.ts = now
+			}
+			return !gcraAllowAt(w, st).After(now)
+		},
+		take: func(w sx.RateLimitWindow, st *windowState, now time.Time) {
+			st.ts = st.ts.Add(w.Period / time.Duration(w.Limit))
+		},
+		result: func(w sx.RateLimitWindow, st *windowState, now time.Time, allowed bool) sx.RateLimitResult {
+			interval := w.Period / time.Duration(w.Limit)
+			reset := st.ts.Sub(now)
+			if !allowed {
+				reset = gcraAllowAt(w, st).Sub(now)
+			}
+			return sx.RateLimitResult{
+				Allowed:   allowed,
+				Limit:     w.Limit,
+				Remaining: int(math.Floor(float64(now.Sub(st.ts))/float64(interval))) + w.Burst,
+				Reset:     reset,
+			}
+		},
+	},
+}
+
+func slidingEstimate(w sx.RateLimitWindow, st *windowState, now time.Time) float64 {
+	return st.prev*(1-float64(elapsed(w, now))/float64(w.Period)) + st.count
+}
+
+// gcraAllowAt returns when the next request is allowed to arrive.
+func gcraAllowAt(w sx.RateLimitWindow, st *windowState) time.Time {
+	interval := w.Period / time.Duration(w.Limit)
+	return st.ts.Add(interval - time.Duration(w.Burst)*interval)
+}
+
+func (l *limitShard) rateLimit(k, algorithm string, windows []sx.RateLimitWindow, now time.Time) (sx.RateLimitResult, error) {
+	alg, ok := algorithms[algorithm]
+	if !ok {
+		return sx.RateLimitResult{}, errors.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	k = algorithm + ":" + k
+	e, ok := l.entries[k]
+	if !ok {
+		e = &limitEntry{windows: make(map[time.Duration]*windowState)}
+		l.entries[k] = e
+	}
+	// check all windows first
+	states := make([]*windowState, len(windows))
+	allowed := make([]bool, len(windows))
+	ok = true
+	for i, w := range windows {
+		st, exists := e.windows[w.Period]
+		if !exists {
+			st = new(windowState)
+			e.windows[w.Period] = st
+		}
+		states[i] = st
+		allowed[i] = alg.refresh(w, st, now)
+		ok = ok && allowed[i]
+	}
+	// then count the request if all of them allow it
+	results := make([]sx.RateLimitResult, len(windows))
+	for i, w := range windows {
+		if ok {
+			alg.take(w, states[i], now)
+		}
+		results[i] = alg.result(w, states[i], now, allowed[i])
+		// keep state around until it can't affect any result
+		ttl := 2 * w.Period
+		if refill := time.Duration(w.Burst) * w.Period / time.Duration(w.Limit); refill > ttl {
+			ttl = refill
+		}
+		if expires := now.Add(ttl); expires.After(e.expires) {
+			e.expires = expires
+		}
+	}
+	return sx.MergeRateLimitResults(results), nil
+}
@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestRateLimitAlgorithms(t *testing.T) {
+	windows := []sx.RateLimitWindow{
+		{Limit: 10, Period: time.Minute, Burst: 10},
+		{Limit: 3, Period: time.Second, Burst: 3},
+	}
+	start := time.Unix(1000*60, 0)
+	for _, algorithm := range []string{
+		sx.RateLimitFixedWindow,
+		sx.RateLimitSlidingWindow,
+		sx.RateLimitTokenBucket,
+		sx.RateLimitGCRA,
+	} {
+		t.Run(algorithm, func(t *testing.T) {
+			l := new(limitShard)
+			l.init()
+			for i := 0; i < 3; i++ {
+				res, err := l.rateLimit("k", algorithm, windows, start)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !res.Allowed || res.Limit != 3 || res.Remaining != 2-i {
+					t.Fatalf("request %d: bad result %+v", i, res)
+				}
+			}
+			res, _ := l.rateLimit("k", algorithm, windows, start)
+			// sliding windows need the previous window to fade out too
+			if res.Allowed || res.Remaining != 0 || res.Reset <= 0 || res.Reset > 2*time.Second {
+				t.Fatalf("bad rejection %+v", res)
+			}
+			// the shortest window recovers, the longest keeps counting
+			res, _ = l.rateLimit("k", algorithm, windows, start.Add(2*time.Second))
+			if !res.Allowed {
+				t.Fatalf("request should be allowed after recovering: %+v", res)
+			}
+			for i := 0; i < 20; i++ {
+				res, _ = l.rateLimit("k", algorithm, windows, start.Add(time.Duration(3+i)*time.Second))
+			}
+			if res.Allowed || res.Limit != 10 {
+				t.Fatalf("minute window should have tripped: %+v", res)
+			}
+		})
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	windows := []sx.RateLimitWindow{{Limit: 1, Period: time.Second, Burst: 5}}
+	now := time.Unix(1000, 0)
+	for _, algorithm := range []string{sx.RateLimitTokenBucket, sx.RateLimitGCRA} {
+		l := new(limitShard)
+		l.init()
+		for i := 0; i < 5; i++ {
+			if res, _ := l.rateLimit("k", algorithm, windows, now); !res.Allowed {
+				t.Fatalf("%s: burst request %d rejected", algorithm, i)
+			}
+		}
+		res, _ := l.rateLimit("k", algorithm, windows, now)
+		if res.Allowed || res.Reset != time.Second {
+			t.Errorf("%s: bad rejection %+v", algorithm, res)
+		}
+		if res, _ := l.rateLimit("k", algorithm, windows, now.Add(time.Second)); !res.Allowed {
+			t.Errorf("%s: request should be allowed after refill: %+v", algorithm, res)
+		}
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	windows := []sx.RateLimitWindow{{Limit: 1, Period: time.Second, Burst: 1}}
+	now := time.Unix(1000, 0)
+	l := new(limitShard)
+	l.init()
+	l.rateLimit("a", sx.RateLimitFixedWindow, windows, now)
+	l.rateLimit("b", sx.RateLimitFixedWindow, windows, now.Add(2*sweepInterval))
+	if len(l.entries) != 1 {
+		t.Errorf("expired entries not swept: %v", l.entries)
+	}
+}
@@ -0,0 +1,59 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+)
+
+// rateLimitKeys returns the keys used by the script of the given algorithm
+// for each window.
+func rateLimitKeys(k, algorithm string, windows []sx.RateLimitWindow, now time.Time) (keys []string) {
+	for _, w := range windows {
+		wk := fmt.Sprintf("%s:%s:%d", k, algorithm, int64(w.Period.Seconds()))
+		period := now.UnixNano() / int64(w.Period)
+		switch algorithm {
+		case sx.RateLimitFixedWindow:
+			keys = append(keys, fmt.Sprintf("%s:%d", wk, period))
+		case sx.RateLimitSlidingWindow:
+			keys = append(keys, fmt.Sprintf("%s:%d", wk, period), fmt.Sprintf("%s:%d", wk, period-1))
+		default:
+			keys = append(keys, wk)
+		}
+	}
+	return
+}
+
+// RateLimit atomically counts a request against every window for key k
+// using the given algorithm, and returns the most restrictive result.
+// The request is only counted if all windows allow it.
+func (c *Client) RateLimit(ctx context.Context, k, algorithm string, windows []sx.RateLimitWindow, now time.Time) (sx.RateLimitResult, error) {
+	script, ok := rateLimitScripts[algorithm]
+	if !ok {
+		return sx.RateLimitResult{}, errors.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+	args := []interface{}{now.UnixNano() / int64(time.Microsecond)}
+	for _, w := range windows {
+		args = append(args, w.Limit, int64(w.Period/time.Microsecond), w.Burst)
+	}
+	vals, err := script.Run(ctx, c.nextWrite(), rateLimitKeys(k, algorithm, windows, now), args...).Int64Slice()
+	if err != nil {
+		return sx.RateLimitResult{}, err
+	}
+	if len(vals) != 3*len(windows) {
+		return sx.RateLimitResult{}, errors.Errorf("unexpected rate limit script result %v", vals)
+	}
+	results := make([]sx.RateLimitResult, len(windows))
+	for i, w := range windows {
+		results[i] = sx.RateLimitResult{
+			Allowed:   vals[3*i] == 1,
+			Limit:     w.Limit,
+			Remaining: int(vals[3*i+1]),
+			Reset:     time.Duration(vals[3*i+2]) * time.Microsecond,
+		}
+	}
+	return sx.MergeRateLimitResults(results), nil
+}
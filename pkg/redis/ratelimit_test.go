@@ -0,0 +1,33 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/trapped/sx"
+)
+
+func TestRateLimitKeys(t *testing.T) {
+	windows := []sx.RateLimitWindow{
+		{Limit: 100, Period: time.Hour, Burst: 100},
+		{Limit: 10, Period: time.Minute, Burst: 10},
+	}
+	now := time.Unix(3600*5+90, 0)
+	for _, tc := range []struct {
+		algorithm string
+		keys      []string
+	}{
+		{sx.RateLimitFixedWindow, []string{"k:fixed_window:3600:5", "k:fixed_window:60:301"}},
+		{sx.RateLimitSlidingWindow, []string{
+			"k:sliding_window:3600:5", "k:sliding_window:3600:4",
+			"k:sliding_window:60:301", "k:sliding_window:60:300",
+		}},
+		{sx.RateLimitTokenBucket, []string{"k:token_bucket:3600", "k:token_bucket:60"}},
+		{sx.RateLimitGCRA, []string{"k:gcra:3600", "k:gcra:60"}},
+	} {
+		if keys := rateLimitKeys("k", tc.algorithm, windows, now); !reflect.DeepEqual(keys, tc.keys) {
+			t.Errorf("bad %s keys: %v", tc.algorithm, keys)
+		}
+	}
+}
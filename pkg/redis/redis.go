@@ -14,6 +14,7 @@ import (
 	"time"
 
 	redis "github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
 	"github.com/trapped/sx"
 )
 
@@ -27,14 +28,12 @@ type Client struct {
 }
 
 func (c *Client) nextRead() *redis.Client {
-	next := c.readClients[c.readIdx%uint32(len(c.readClients))]
-	atomic.AddUint32(&c.readIdx, 1)
-	return next
+	n := atomic.AddUint32(&c.readIdx, 1) - 1
+	return c.readClients[n%uint32(len(c.readClients))]
 }
 func (c *Client) nextWrite() *redis.Client {
-	next := c.writeClients[c.writeIdx%uint32(len(c.writeClients))]
-	atomic.AddUint32(&c.writeIdx, 1)
-	return next
+	n := atomic.AddUint32(&c.writeIdx, 1) - 1
+	return c.writeClients[n%uint32(len(c.writeClients))]
 }
 
 // MakeKey joins the provided mode, url and keys into a single cache key string.
@@ -80,6 +79,33 @@ func (c *Client) SetResponse(ctx context.Context, k string, resp *http.Response,
 	r.Seek(0, io.SeekStart)
 }
 
+// Close closes all of the underlying Redis clients.
+func (c *Client) Close() error {
+	var err error
+	// not appended together, which could write to the spare capacity of
+	// readClients while another goroutine does the same
+	for _, clients := range [][]*redis.Client{c.readClients, c.writeClients} {
+		for _, rc := range clients {
+			if cerr := rc.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// Ping checks that every underlying Redis server is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	for _, clients := range [][]*redis.Client{c.readClients, c.writeClients} {
+		for _, rc := range clients {
+			if err := rc.Ping(ctx).Err(); err != nil {
+				return errors.Wrapf(err, "error pinging redis at %s", rc.Options().Addr)
+			}
+		}
+	}
+	return nil
+}
+
 // NewClient initializes a new set of Redis clients according to the specified configuration.
 func NewClient(conf sx.Redis) *Client {
 	c := &Client{
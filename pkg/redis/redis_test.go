@@ -0,0 +1,35 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/trapped/sx"
+)
+
+func TestClientConcurrentPingClose(t *testing.T) {
+	s := miniredis.RunT(t)
+	// three read clients leave spare capacity in their slice
+	c := NewClient(sx.Redis{
+		ReadAddresses:  []string{s.Addr(), s.Addr(), s.Addr()},
+		WriteAddresses: []string{s.Addr()},
+	})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.Ping(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+}
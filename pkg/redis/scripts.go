@@ -0,0 +1,170 @@
+package redis
+
+import (
+	redis "github.com/go-redis/redis/v8"
+	"github.com/trapped/sx"
+)
+
+/*
+	Rate limit scripts check every window first, and only count the request
+	if all of them allow it, so they are evaluated atomically by Redis.
+
+	Arguments are shared by all scripts:
+	- ARGV[1] is the current time in microseconds
+	- ARGV[3*i-1], ARGV[3*i] and ARGV[3*i+1] are the limit, period (in
+	  microseconds) and burst of the i-th window
+
+	All scripts return allowed (1 or 0), remaining and reset (in
+	microseconds) for each window.
+*/
+
+// fixedWindowScript counts requests in fixed windows.
+// KEYS[i] is the counter of the i-th window for the current period.
+const fixedWindowScript = `
+local now = tonumber(ARGV[1])
+local counts, ok = {}, true
+for i = 1, #KEYS do
+	counts[i] = tonumber(redis.call('GET', KEYS[i]) or '0')
+	if counts[i] >= tonumber(ARGV[3*i-1]) then
+		ok = false
+	end
+end
+local res = {}
+for i = 1, #KEYS do
+	local limit, period = tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i])
+	local allowed = counts[i] < limit
+	if ok then
+		counts[i] = redis.call('INCR', KEYS[i])
+		redis.call('PEXPIRE', KEYS[i], math.ceil(period / 1000))
+	end
+	res[3*i-2] = allowed and 1 or 0
+	res[3*i-1] = limit - counts[i]
+	res[3*i] = period - now % period
+end
+return res
+`
+
+// slidingWindowScript approximates a sliding window by weighting the
+// previous fixed window counter by how much of it still overlaps.
+// KEYS[2*i-1] and KEYS[2*i] are the counters of the i-th window for the
+// current and previous periods.
+const slidingWindowScript = `
+local now = tonumber(ARGV[1])
+local cur, prev, est, ok = {}, {}, {}, true
+for i = 1, #KEYS / 2 do
+	local limit, period = tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i])
+	cur[i] = tonumber(redis.call('GET', KEYS[2*i-1]) or '0')
+	prev[i] = tonumber(redis.call('GET', KEYS[2*i]) or '0')
+	est[i] = prev[i] * (1 - (now % period) / period) + cur[i]
+	if est[i] + 1 > limit then
+		ok = false
+	end
+end
+local res = {}
+for i = 1, #KEYS / 2 do
+	local limit, period = tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i])
+	local elapsed = now % period
+	local allowed = est[i] + 1 <= limit
+	if ok then
+		cur[i] = redis.call('INCR', KEYS[2*i-1])
+		redis.call('PEXPIRE', KEYS[2*i-1], math.ceil(2 * period / 1000))
+		est[i] = est[i] + 1
+	end
+	local reset = period - elapsed
+	if not allowed then
+		if prev[i] > 0 and cur[i] + 1 <= limit then
+			-- the previous window fades out enough during this one
+			reset = (est[i] + 1 - limit) * period / prev[i]
+		else
+			-- wait for this window to become the previous one
+			reset = period - elapsed + math.max(0, 1 - (limit - 1) / cur[i]) * period
+		end
+	end
+	res[3*i-2] = allowed and 1 or 0
+	res[3*i-1] = math.floor(limit - est[i])
+	res[3*i] = math.ceil(reset)
+end
+return res
+`
+
+// tokenBucketScript refills buckets of burst tokens at limit/period
+// tokens per microsecond; each request takes one token.
+// KEYS[i] is the bucket of the i-th window.
+const tokenBucketScript = `
+local now = tonumber(ARGV[1])
+local tokens, ok = {}, true
+for i = 1, #KEYS do
+	local limit, period, burst = tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i]), tonumber(ARGV[3*i+1])
+	local state = redis.call('HMGET', KEYS[i], 'tokens', 'ts')
+	local t, ts = tonumber(state[1]), tonumber(state[2])
+	if t == nil or ts == nil then
+		t, ts = burst, now
+	end
+	tokens[i] = math.min(burst, t + math.max(0, now - ts) * limit / period)
+	if tokens[i] < 1 then
+		ok = false
+	end
+end
+local res = {}
+for i = 1, #KEYS do
+	local limit, period, burst = tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i]), tonumber(ARGV[3*i+1])
+	local rate = limit / period
+	local allowed = tokens[i] >= 1
+	if ok then
+		tokens[i] = tokens[i] - 1
+		redis.call('HSET', KEYS[i], 'tokens', tokens[i], 'ts', now)
+		redis.call('PEXPIRE', KEYS[i], math.ceil((burst - tokens[i]) / rate / 1000) + 1)
+	end
+	local reset = (burst - tokens[i]) / rate
+	if not allowed then
+		reset = (1 - tokens[i]) / rate
+	end
+	res[3*i-2] = allowed and 1 or 0
+	res[3*i-1] = math.floor(tokens[i])
+	res[3*i] = math.ceil(reset)
+end
+return res
+`
+
+// gcraScript implements the generic cell rate algorithm, storing the
+// theoretical arrival time of the next request. Intervals are truncated to
+// whole microseconds, like the in-memory limiter truncates them to
+// nanoseconds; validation rejects windows with shorter intervals.
+// KEYS[i] is the theoretical arrival time of the i-th window.
+const gcraScript = `
+local now = tonumber(ARGV[1])
+local tats, ok = {}, true
+for i = 1, #KEYS do
+	local limit, period, burst = tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i]), tonumber(ARGV[3*i+1])
+	local interval = math.floor(period / limit)
+	tats[i] = math.max(tonumber(redis.call('GET', KEYS[i]) or '0'), now)
+	if tats[i] + interval - burst * interval > now then
+		ok = false
+	end
+end
+local res = {}
+for i = 1, #KEYS do
+	local limit, period, burst = tonumber(ARGV[3*i-1]), tonumber(ARGV[3*i]), tonumber(ARGV[3*i+1])
+	local interval = math.floor(period / limit)
+	local allowed = tats[i] + interval - burst * interval <= now
+	if ok then
+		tats[i] = tats[i] + interval
+		redis.call('SET', KEYS[i], tats[i], 'PX', math.ceil((tats[i] - now) / 1000) + 1)
+	end
+	local reset = tats[i] - now
+	if not allowed then
+		reset = tats[i] + interval - burst * interval - now
+	end
+	res[3*i-2] = allowed and 1 or 0
+	res[3*i-1] = math.floor((now - tats[i]) / interval) + burst
+	res[3*i] = math.ceil(reset)
+end
+return res
+`
+
+var rateLimitScripts = map[string]*redis.Script{
+	sx.RateLimitFixedWindow:   redis.NewScript(fixedWindowScript),
+	sx.RateLimitSlidingWindow: redis.NewScript(slidingWindowScript),
+	sx.RateLimitTokenBucket:   redis.NewScript(tokenBucketScript),
+	sx.RateLimitGCRA:          redis.NewScript(gcraScript),
+}
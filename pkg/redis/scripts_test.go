@@ -0,0 +1,123 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/trapped/sx"
+	"github.com/trapped/sx/pkg/memory"
+)
+
+// scriptAlgorithms are the rate limit algorithms whose scripts are tested
+// against miniredis.
+var scriptAlgorithms = []string{
+	sx.RateLimitFixedWindow,
+	sx.RateLimitSlidingWindow,
+	sx.RateLimitTokenBucket,
+	sx.RateLimitGCRA,
+}
+
+func newTestClient(t *testing.T) *Client {
+	s := miniredis.RunT(t)
+	c := NewClient(sx.Redis{ReadAddresses: []string{s.Addr()}, WriteAddresses: []string{s.Addr()}})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestRateLimitScripts(t *testing.T) {
+	windows := []sx.RateLimitWindow{
+		{Limit: 10, Period: time.Minute, Burst: 10},
+		{Limit: 3, Period: time.Second, Burst: 3},
+	}
+	start := time.Unix(1000*60, 0)
+	ctx := context.Background()
+	for _, algorithm := range scriptAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			c := newTestClient(t)
+			for i := 0; i < 3; i++ {
+				res, err := c.RateLimit(ctx, "k", algorithm, windows, start)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !res.Allowed || res.Limit != 3 || res.Remaining != 2-i {
+					t.Fatalf("request %d: bad result %+v", i, res)
+				}
+			}
+			res, _ := c.RateLimit(ctx, "k", algorithm, windows, start)
+			// sliding windows need the previous window to fade out too
+			if res.Allowed || res.Remaining != 0 || res.Reset <= 0 || res.Reset > 2*time.Second {
+				t.Fatalf("bad rejection %+v", res)
+			}
+			// the shortest window recovers, the longest keeps counting
+			res, _ = c.RateLimit(ctx, "k", algorithm, windows, start.Add(2*time.Second))
+			if !res.Allowed {
+				t.Fatalf("request should be allowed after recovering: %+v", res)
+			}
+			for i := 0; i < 20; i++ {
+				res, _ = c.RateLimit(ctx, "k", algorithm, windows, start.Add(time.Duration(3+i)*time.Second))
+			}
+			if res.Allowed || res.Limit != 10 {
+				t.Fatalf("minute window should have tripped: %+v", res)
+			}
+		})
+	}
+}
+
+func TestRateLimitScriptsBurst(t *testing.T) {
+	windows := []sx.RateLimitWindow{{Limit: 1, Period: time.Second, Burst: 5}}
+	now := time.Unix(1000, 0)
+	ctx := context.Background()
+	for _, algorithm := range []string{sx.RateLimitTokenBucket, sx.RateLimitGCRA} {
+		c := newTestClient(t)
+		for i := 0; i < 5; i++ {
+			if res, _ := c.RateLimit(ctx, "k", algorithm, windows, now); !res.Allowed {
+				t.Fatalf("%s: burst request %d rejected", algorithm, i)
+			}
+		}
+		res, _ := c.RateLimit(ctx, "k", algorithm, windows, now)
+		if res.Allowed || res.Reset != time.Second {
+			t.Errorf("%s: bad rejection %+v", algorithm, res)
+		}
+		if res, _ := c.RateLimit(ctx, "k", algorithm, windows, now.Add(time.Second)); !res.Allowed {
+			t.Errorf("%s: request should be allowed after refill: %+v", algorithm, res)
+		}
+	}
+}
+
+// TestRateLimitScriptsMemory checks that the scripts and the in-memory
+// rate limiter agree on the same sequence of requests. Periods are whole
+// multiples of the limits, so that GCRA intervals aren't truncated.
+func TestRateLimitScriptsMemory(t *testing.T) {
+	windows := []sx.RateLimitWindow{
+		{Limit: 5, Period: time.Second, Burst: 8},
+		{Limit: 20, Period: time.Minute, Burst: 20},
+	}
+	start := time.Unix(1000*60, 0)
+	ctx := context.Background()
+	for _, algorithm := range scriptAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			c := newTestClient(t)
+			m := memory.NewStore(sx.Memory{})
+			now := start
+			for i := 0; i < 60; i++ {
+				// bursts of requests, with pauses in between
+				now = now.Add(time.Duration(i%7*i%5) * 37 * time.Millisecond)
+				expected, err := m.RateLimit(ctx, "k", algorithm, windows, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := c.RateLimit(ctx, "k", algorithm, windows, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// scripts round resets up to microseconds, not nanoseconds
+				diff := res.Reset - expected.Reset
+				if res.Allowed != expected.Allowed || res.Limit != expected.Limit || res.Remaining != expected.Remaining || diff < -time.Microsecond || diff > time.Microsecond {
+					t.Fatalf("request %d at %s: redis %+v, memory %+v", i, now.Sub(start), res, expected)
+				}
+			}
+		})
+	}
+}
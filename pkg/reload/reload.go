@@ -0,0 +1,222 @@
+// package reload implements transactional configuration reloads, keeping
+// the last known good configuration when a new one can't be applied.
+package reload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/trapped/sx"
+)
+
+var (
+	metricConfigGeneration = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sx",
+		Subsystem: "config",
+		Name:      "generation",
+		Help:      "Generation of the configuration in use, incremented by each successful reload",
+	})
+	metricConfigLastReload = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sx",
+		Subsystem: "config",
+		Name:      "last_reload_timestamp_seconds",
+		Help:      "Timestamp of the last reload attempt",
+	})
+	metricConfigLastReloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sx",
+		Subsystem: "config",
+		Name:      "last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful reload",
+	})
+	metricConfigLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sx",
+		Subsystem: "config",
+		Name:      "last_reload_successful",
+		Help:      "Whether the last reload attempt was successful (1) or not (0)",
+	})
+	metricConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sx",
+		Subsystem: "config",
+		Name:      "reloads_total",
+		Help:      "Count of reload attempts by trigger and result",
+	}, []string{"trigger", "result"})
+)
+
+// Reload triggers.
+const (
+	TriggerStartup = "startup"
+	TriggerWatch   = "watch"
+	TriggerSignal  = "signal"
+	TriggerAdmin   = "admin"
+)
+
+// Loader applies a validated configuration, compiling its routes and
+// building its backends, and swaps it in only if all of them succeed.
+type Loader interface {
+	LoadConfig(conf *sx.GatewayConfig) error
+}
+
+// Status reports the outcome of the last reload attempt.
+type Status struct {
+	// Generation is incremented by each successful reload.
+	Generation int64 `json:"generation"`
+	// Checksum is the SHA-256 of the configuration in use.
+	Checksum    string    `json:"checksum,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	LastSuccess time.Time `json:"last_success"`
+	// Trigger is what caused the last reload attempt.
+	Trigger string `json:"trigger"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Reloader reads, validates and applies the configuration at path to a
+// Loader. Failed reloads leave the last known good configuration in use.
+type Reloader struct {
+	path   string
+	loader Loader
+	// Token, if set, must be sent as a bearer token to reload with POST
+	// /reload; otherwise only loopback clients can.
+	Token string
+
+	mu       sync.Mutex
+	status   Status
+	lastGood *sx.GatewayConfig
+}
+
+// New returns a Reloader for the configuration file at path.
+func New(path string, loader Loader) *Reloader {
+	return &Reloader{path: path, loader: loader}
+}
+
+// Reload runs the reload pipeline: read, parse, validate, then load the
+// configuration (compiling routes, building backends and swapping).
+// Any failure aborts the reload, keeping the last known good configuration.
+// Concurrent reloads are serialized.
+func (r *Reloader) Reload(trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.status.Timestamp = now
+	r.status.Trigger = trigger
+	metricConfigLastReload.Set(float64(now.Unix()))
+
+	conf, checksum, err := r.load()
+	if err != nil {
+		r.status.Error = err.Error()
+		metricConfigLastReloadSuccessful.Set(0)
+		metricConfigReloads.WithLabelValues(trigger, "failure").Inc()
+		if r.lastGood != nil {
+			log.Printf("error reloading configuration (%s), keeping generation %d: %v", trigger, r.status.Generation, err)
+		}
+		return err
+	}
+	r.lastGood = conf
+	r.status.Generation++
+	r.status.Checksum = checksum
+	r.status.LastSuccess = now
+	r.status.Error = ""
+	metricConfigGeneration.Set(float64(r.status.Generation))
+	metricConfigLastReloadSuccess.Set(float64(now.Unix()))
+	metricConfigLastReloadSuccessful.Set(1)
+	metricConfigReloads.WithLabelValues(trigger, "success").Inc()
+	log.Printf("loaded configuration generation %d (%s)", r.status.Generation, trigger)
+	for _, w := range conf.Warnings() {
+		log.Printf("warning: %s", w)
+	}
+	return nil
+}
+
+func (r *Reloader) load() (*sx.GatewayConfig, string, error) {
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error reading configuration")
+	}
+	sum := sha256.Sum256(b)
+	conf := new(sx.GatewayConfig)
+	if err := conf.Decode(bytes.NewReader(b)); err != nil {
+		return nil, "", errors.Wrap(err, "error parsing configuration")
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, "", errors.Wrap(err, "error validating configuration")
+	}
+	if err := r.loader.LoadConfig(conf); err != nil {
+		return nil, "", errors.Wrap(err, "error loading configuration")
+	}
+	return conf, hex.EncodeToString(sum[:]), nil
+}
+
+// Status returns the outcome of the last reload attempt.
+func (r *Reloader) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// LastGood returns the configuration in use, or nil if none was loaded.
+func (r *Reloader) LastGood() *sx.GatewayConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastGood
+}
+
+// ServeHTTP reports the reload status as JSON on GET, or reloads the
+// configuration on POST and reports the outcome, with status 500 if the
+// reload failed.
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	code := http.StatusOK
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if r.Token != "" && !r.validToken(req) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="reload"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Token == "" && !loopback(req) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if err := r.Reload(TriggerAdmin); err != nil {
+			code = http.StatusInternalServerError
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(r.Status())
+}
+
+// validToken reports whether req carries the reload token.
+func (r *Reloader) validToken(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(r.Token)) == 1
+}
+
+// loopback reports whether req comes from a loopback address.
+func loopback(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,168 @@
+package reload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/trapped/sx"
+)
+
+type mockLoader struct {
+	conf *sx.GatewayConfig
+	err  error
+}
+
+func (m *mockLoader) LoadConfig(conf *sx.GatewayConfig) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.conf = conf
+	return nil
+}
+
+const validConfig = `
+services:
+  - name: mock
+    addresses: ["localhost:8080"]
+`
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sx-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := new(mockLoader)
+	r := New(path, l)
+	if err := r.Reload(TriggerWatch); err == nil {
+		t.Fatalf("missing configuration should fail")
+	}
+	if r.LastGood() != nil || r.Status().Generation != 0 {
+		t.Fatalf("failed reload should not change generation")
+	}
+
+	write(validConfig)
+	if err := r.Reload(TriggerWatch); err != nil {
+		t.Fatal(err)
+	}
+	good := r.LastGood()
+	if good == nil || l.conf != good || r.Status().Generation != 1 || r.Status().Checksum == "" {
+		t.Fatalf("bad status after reload: %+v", r.Status())
+	}
+
+	for _, tc := range []struct {
+		conf, loadErr, err string
+	}{
+		{"services: [", "", "error parsing configuration"},
+		{"services:\n  - name: mock\n", "", "error validating configuration"},
+		{validConfig, "bad backend", "error loading configuration: bad backend"},
+	} {
+		write(tc.conf)
+		l.err = nil
+		if tc.loadErr != "" {
+			l.err = errors.New(tc.loadErr)
+		}
+		err := r.Reload(TriggerWatch)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("bad reload error: %v", err)
+		}
+		status := r.Status()
+		if r.LastGood() != good || status.Generation != 1 || status.Error != err.Error() {
+			t.Errorf("last known good configuration not kept: %+v", status)
+		}
+	}
+
+	serve := func(method string, code int) (status Status) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/reload", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		r.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("bad %s status code: %v", method, rec.Code)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if status := serve("GET", 200); status.Generation != 1 || status.Error == "" || status.Trigger != TriggerWatch {
+		t.Errorf("bad status: %+v", status)
+	}
+	if status := serve("POST", 500); status.Generation != 1 || status.Error == "" || status.Trigger != TriggerAdmin {
+		t.Errorf("bad status: %+v", status)
+	}
+	l.err = nil
+	if status := serve("POST", 200); status.Generation != 2 || status.Error != "" {
+		t.Errorf("bad status: %+v", status)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("PUT", "/reload", nil))
+	if rec.Code != 405 {
+		t.Errorf("bad PUT status code: %v", rec.Code)
+	}
+}
+
+func TestReloaderAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sx-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(validConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := New(path, new(mockLoader))
+	post := func(remote, auth string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/reload", nil)
+		req.RemoteAddr = remote
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// without a token, only loopback clients can reload
+	for _, tc := range []struct {
+		remote string
+		code   int
+	}{
+		{"127.0.0.1:1234", 200},
+		{"[::1]:1234", 200},
+		{"10.0.0.1:1234", 403},
+	} {
+		if code := post(tc.remote, ""); code != tc.code {
+			t.Errorf("%s: bad status code %d", tc.remote, code)
+		}
+	}
+	r.Token = "secret"
+	for _, tc := range []struct {
+		auth string
+		code int
+	}{
+		{"", 401},
+		{"Bearer wrong", 401},
+		{"Bearer secret", 200},
+	} {
+		if code := post("10.0.0.1:1234", tc.auth); code != tc.code {
+			t.Errorf("%q: bad status code %d", tc.auth, code)
+		}
+	}
+	if r.Status().Generation != 3 {
+		t.Errorf("unauthorized requests reloaded: %+v", r.Status())
+	}
+}
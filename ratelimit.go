@@ -0,0 +1,55 @@
+package sx
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitResult is the outcome of counting a request against one or
+// more rate limit windows.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+// MergeRateLimitResults reduces per-window results to the most
+// restrictive one: the rejecting window that resets last, or else the
+// window with the fewest remaining requests.
+func MergeRateLimitResults(rs []RateLimitResult) (res RateLimitResult) {
+	res.Allowed = true
+	for i, r := range rs {
+		switch {
+		case i == 0:
+			res = r
+		case !r.Allowed && res.Allowed:
+			res = r
+		case r.Allowed != res.Allowed:
+			continue
+		case !r.Allowed && r.Reset > res.Reset:
+			res = r
+		case r.Allowed && (r.Remaining < res.Remaining || r.Remaining == res.Remaining && r.Reset > res.Reset):
+			res = r
+		}
+	}
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+	return
+}
+
+// SetHeaders sets the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers, plus Retry-After if the request was rejected.
+// Times are rounded up to the next second.
+func (r RateLimitResult) SetHeaders(h http.Header) {
+	reset := strconv.Itoa(int(math.Ceil(r.Reset.Seconds())))
+	h.Set("RateLimit-Limit", strconv.Itoa(r.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	h.Set("RateLimit-Reset", reset)
+	if !r.Allowed {
+		h.Set("Retry-After", reset)
+	}
+}
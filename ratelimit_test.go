@@ -0,0 +1,42 @@
+package sx
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMergeRateLimitResults(t *testing.T) {
+	allowed := MergeRateLimitResults([]RateLimitResult{
+		{true, 100, 40, time.Hour},
+		{true, 10, 4, 30 * time.Second},
+		{true, 5, 4, 500 * time.Millisecond},
+	})
+	if allowed != (RateLimitResult{true, 10, 4, 30 * time.Second}) {
+		t.Errorf("bad merged result: %+v", allowed)
+	}
+	rejected := MergeRateLimitResults([]RateLimitResult{
+		{false, 100, -1, time.Hour},
+		{true, 10, 4, 30 * time.Second},
+		{false, 5, -1, 500 * time.Millisecond},
+	})
+	if rejected != (RateLimitResult{false, 100, 0, time.Hour}) {
+		t.Errorf("bad merged result: %+v", rejected)
+	}
+}
+
+func TestRateLimitResultSetHeaders(t *testing.T) {
+	h := http.Header{}
+	RateLimitResult{true, 10, 4, 1500 * time.Millisecond}.SetHeaders(h)
+	if h.Get("RateLimit-Limit") != "10" || h.Get("RateLimit-Remaining") != "4" || h.Get("RateLimit-Reset") != "2" {
+		t.Errorf("bad headers: %v", h)
+	}
+	if h.Get("Retry-After") != "" {
+		t.Errorf("unexpected Retry-After: %v", h.Get("Retry-After"))
+	}
+	h = http.Header{}
+	RateLimitResult{false, 10, 0, 30 * time.Second}.SetHeaders(h)
+	if h.Get("Retry-After") != "30" {
+		t.Errorf("bad Retry-After: %v", h.Get("Retry-After"))
+	}
+}
@@ -17,6 +17,11 @@ func (r *Route) Match(path string) bool {
 	return r.CompiledPattern.Match(path)
 }
 
+// MatchMethod reports whether the route accepts method.
+func (r *Route) MatchMethod(method string) bool {
+	return r.RouteGroup.Method == "" || r.RouteGroup.Method == method
+}
+
 func NewRoute(r *RouteGroup) (Route, error) {
 	pattern := fmt.Sprintf("%s%s", r.ParentService.PathPrefix, r.AbsolutePath())
 	compiled, err := glob.Compile(pattern)
@@ -0,0 +1,20 @@
+package sx
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Store is a backend for response caching and rate limiting.
+type Store interface {
+	// MakeKey joins the provided mode, url and keys into a single key.
+	MakeKey(mode, url string, keys []string) string
+	// GetResponse fetches a previously cached HTTP response.
+	GetResponse(ctx context.Context, k string) (*http.Response, bool)
+	// SetResponse caches an HTTP response with the provided TTL.
+	SetResponse(ctx context.Context, k string, resp *http.Response, ttl time.Duration)
+	// RateLimit counts a request against every window for key k using
+	// the given algorithm, and returns the most restrictive result.
+	RateLimit(ctx context.Context, k, algorithm string, windows []RateLimitWindow, now time.Time) (RateLimitResult, error)
+}